@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 // Command todo
@@ -17,6 +18,8 @@ type Command struct {
 	SplitNumber int
 	// 是否忽略非0的返回值。默认false
 	IgnoreExitCode bool
+	// 返回值为1并且stderr为空时当成什么都没找到，不算出错。lsof、grep 找不到东西时就是这样。默认false
+	NoMatchExitCode bool
 }
 
 // NewCommand todo
@@ -34,21 +37,31 @@ func NewCommand(c string, args ...string) *Command {
 func (t *Command) Run() ([]*CommandResultLine, error) {
 	c := exec.Command(t.cmd, t.args...)
 	buffer := bytes.Buffer{}
+	stderr := bytes.Buffer{}
 	c.Stdout = &buffer
+	c.Stderr = &stderr
 	c.Env = append(os.Environ(), "COLUMNS=1000")
 	err := c.Run()
+	if ee, ok := err.(*exec.ExitError); ok && t.NoMatchExitCode && ee.ExitCode() == 1 && stderr.Len() == 0 {
+		err = nil
+	}
 	if err != nil && !t.IgnoreExitCode {
 		return nil, err
 	}
 
 	// log.Printf("%s", buffer.String())
 
+	return ParseLines(buffer.String(), t.TrimSpace, t.SplitNumber), nil
+}
+
+// ParseLines 把一段文本按行切分成和Command.Run一样的结果。用于输出不是通过Command得到的情况
+func ParseLines(s string, trim bool, splitNumber int) []*CommandResultLine {
 	results := []*CommandResultLine{}
-	scanner := bufio.NewScanner(&buffer)
+	scanner := bufio.NewScanner(strings.NewReader(s))
 	for scanner.Scan() {
 		txt := scanner.Text()
 		// log.Println(txt)
-		rl := newCommandResultLine(txt, t.TrimSpace, t.SplitNumber)
+		rl := newCommandResultLine(txt, trim, splitNumber)
 		// log.Printf("%s new DONE\n", txt)
 		results = append(results, rl)
 		// log.Printf("%s append DONE\n", txt)
@@ -56,7 +69,7 @@ func (t *Command) Run() ([]*CommandResultLine, error) {
 
 	// log.Println("END")
 
-	return results, nil
+	return results
 }
 
 // RunCommand run a command and get result of stdout
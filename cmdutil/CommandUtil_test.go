@@ -38,3 +38,23 @@ func TestRunEchoFields(t *testing.T) {
 		t.Error()
 	}
 }
+
+func TestRunNoMatch(t *testing.T) {
+	c := NewCommand("sh", "-c", "echo 1; exit 1")
+	if _, err := c.Run(); err == nil {
+		t.Error("should fail")
+	}
+
+	c.NoMatchExitCode = true
+	lines, err := c.Run()
+	if err != nil || len(lines) != 1 {
+		t.Errorf("%s %v", err, lines)
+	}
+
+	// 有错误输出的还是出错
+	c = NewCommand("sh", "-c", "echo oops >&2; exit 1")
+	c.NoMatchExitCode = true
+	if _, err := c.Run(); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -2,74 +2,325 @@ package conf
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/wanghengwei/monclient/proc"
 )
 
 type Config struct {
-	Command struct {
-		Includes []string `json:"includes"`
-		Excludes []string `json:"excludes"`
-	} `json:"command"`
+	Agent AgentConfig `json:"agent" yaml:"agent"`
+
+	Command CommandConfig `json:"command" yaml:"command"`
+
+	// 按容器、systemd unit选进程，和command一起用
+	Cgroup CgroupConfig `json:"cgroup" yaml:"cgroup"`
 
-	Port struct {
-		Excludes []string `json:"excludes"`
-	} `json:"port"`
+	Port PortConfig `json:"port" yaml:"port"`
+
+	Client ClientConfig `json:"client" yaml:"client"`
 
 	X51Log struct {
-		Folder string `json:"folder"`
-	} `json:"x51log"`
+		Folder string `json:"folder" yaml:"folder"`
+	} `json:"x51log" yaml:"x51log"`
+
+	// 进程分组，按顺序匹配，进程属于第一个匹配的组
+	Groups []GroupConfig `json:"groups,omitempty" yaml:"groups"`
+
+	// 只对部分主机生效的配置，按顺序合并到上面的配置里，见 ForHost
+	Rules []RuleBlock `json:"rules,omitempty" yaml:"rules"`
+}
+
+// AgentConfig monclient自己的设置
+type AgentConfig struct {
+	// 导出指标的http地址
+	ListenAddress string `json:"listen_address" yaml:"listen_address"`
+	// 两次抓取间隔小于这个时间时用上次采集的结果
+	SnapInterval Duration `json:"snap_interval" yaml:"snap_interval"`
+	// 配置服务器的地址，为空表示不从配置服务器读
+	ConfigURL string `json:"config_url" yaml:"config_url"`
+	// 以daemon方式运行时的pid文件
+	PidFile string `json:"pid_file" yaml:"pid_file"`
+	// 日志目录，为空时用glog默认的
+	LogFolder string `json:"log_folder" yaml:"log_folder"`
+	// 为true时每个匹配的进程再导出一份连同子孙进程的总和
+	Rollup bool `json:"rollup" yaml:"rollup"`
+	// 进程退出以后多久以内同一个组（不属于组的话同样的命令行）又有进程启动，算作重启
+	RestartWindow Duration `json:"restart_window" yaml:"restart_window"`
+	// 为true时进程的指标带上container和unit标签。只在启动时读一次
+	CgroupLabels bool `json:"cgroup_labels" yaml:"cgroup_labels"`
+	// 为true时从cgroupfs读记录的进程所在的unit、容器的cpu、内存、io、pids，cgroupfs的位置见 -cgroup-root
+	CgroupStats bool `json:"cgroup_stats" yaml:"cgroup_stats"`
+	// 怎么统计发出的流量：port 按监听端口和对外连接加规则；
+	// cgroup 对unit、容器里的进程每个cgroup一条规则，连接再短也统计得到，要iptables支持cgroup match，不支持的话还是按port
+	TrafficMode string `json:"traffic_mode" yaml:"traffic_mode"`
+}
+
+// CommandConfig 哪些进程需要记录，都是正则表达式
+type CommandConfig struct {
+	Includes []string `json:"includes" yaml:"includes"`
+	Excludes []string `json:"excludes" yaml:"excludes"`
+	// 为true时匹配的进程的子孙进程也算上，除非被excludes排除
+	Descendants bool `json:"descendants" yaml:"descendants"`
+}
+
+// CgroupConfig 按进程所在的容器、systemd unit选进程，需要用procfs（-source=procfs）读进程信息。
+// 命令行匹配 command.includes，或者容器ID、unit匹配这里的includes，进程就会记录；
+// 命令行、容器ID、unit有一个匹配excludes就不记录。
+// 不在容器里、不是systemd管的进程不匹配这里的任何条件
+type CgroupConfig struct {
+	// 容器ID的正则表达式，docker、containerd、cri-o、podman的容器都认得
+	Containers PatternConfig `json:"containers" yaml:"containers"`
+	// systemd unit的正则表达式，比如 ^nginx\.service$
+	Units PatternConfig `json:"units" yaml:"units"`
+}
+
+// PatternConfig 一对正则表达式的黑白名单
+type PatternConfig struct {
+	Includes []string `json:"includes" yaml:"includes"`
+	Excludes []string `json:"excludes" yaml:"excludes"`
+}
+
+// ClientConfig 对外连接发出的流量怎么汇总。
+// 和很多对端通信的进程，每个地址、端口一条规则和一个序列太多了，可以汇总起来
+type ClientConfig struct {
+	// address 每个远端地址和端口单独统计；port 只按远端端口；cidr 按远端网段和端口；
+	// service 按services里配置的网段，所有端口算在一起，不在任何网段里的地址还是单独统计
+	Aggregate string `json:"aggregate" yaml:"aggregate"`
+	// cidr 汇总时网段的前缀长度
+	IPv4Prefix int `json:"ipv4_prefix" yaml:"ipv4_prefix"`
+	IPv6Prefix int `json:"ipv6_prefix" yaml:"ipv6_prefix"`
+	// service 汇总时每个服务的网段，按顺序匹配。导出的指标里addr标签是服务名
+	Services []ServiceConfig `json:"services" yaml:"services"`
+}
+
+// ServiceConfig 一个远端服务有哪些网段
+type ServiceConfig struct {
+	Name  string   `json:"name" yaml:"name"`
+	CIDRs []string `json:"cidrs" yaml:"cidrs"`
+}
+
+// client.aggregate 的取值，就是 proc.ClientAggregator 支持的汇总方式
+const (
+	AggregateByAddress = proc.AggregateByAddress
+	AggregateByPort    = proc.AggregateByPort
+	AggregateByCIDR    = proc.AggregateByCIDR
+	AggregateByService = proc.AggregateByService
+)
+
+// GroupConfig 一组进程。写了的条件都要满足
+type GroupConfig struct {
+	// 导出的指标里group标签的值
+	Name string `json:"name" yaml:"name"`
+	// 命令行的正则表达式，没写includes的话所有命令行都行
+	Command CommandConfig `json:"command" yaml:"command"`
+	// 进程的用户名，为空表示不限制
+	User string `json:"user,omitempty" yaml:"user"`
+	// cgroup路径的正则表达式，为空表示不限制
+	Cgroup string `json:"cgroup,omitempty" yaml:"cgroup"`
+	// 为true时读组里进程的smaps，导出PSS和USS。读smaps比较慢，只给需要的组打开
+	Smaps bool `json:"smaps,omitempty" yaml:"smaps"`
+}
+
+// PortConfig 哪些端口不需要统计流量，格式见 ParsePortSpec
+type PortConfig struct {
+	Excludes []string `json:"excludes" yaml:"excludes"`
+	// 哪些监听端口还要按远端地址统计进来的流量
+	Peers []PeerConfig `json:"peers" yaml:"peers"`
+}
+
+// PeerConfig 一个监听端口按远端地址统计进来的流量，比如网关被打爆时看是哪个上游。
+// 每个远端地址一条规则，所以要限制数量
+type PeerConfig struct {
+	Port int `json:"port" yaml:"port"`
+	// 只导出进来流量最多的几个远端地址，为0时是10
+	Top int `json:"top,omitempty" yaml:"top"`
+	// 最多给多少个远端地址加规则，为0时是100。超过的话先留正连着的，再留流量大的
+	MaxTracked int `json:"max_tracked,omitempty" yaml:"max_tracked"`
+}
+
+// 没写时的 PeerConfig.Top 和 PeerConfig.MaxTracked
+const (
+	DefaultPeerTop        = 10
+	DefaultPeerMaxTracked = 100
+)
+
+// Defaults 返回默认配置
+func Defaults() *Config {
+	cfg := &Config{}
+	cfg.Agent.ListenAddress = ":10001"
+	cfg.Agent.SnapInterval = Duration(10 * time.Second)
+	cfg.Agent.ConfigURL = "http://cfg.monitor.tac.com/monclient-default.json"
+	cfg.Agent.PidFile = "/tmp/monclient.pid"
+	cfg.Agent.RestartWindow = Duration(5 * time.Minute)
+	cfg.Agent.TrafficMode = TrafficByPort
+	cfg.Command.Includes = []string{}
+	cfg.Command.Excludes = []string{}
+	cfg.Cgroup.Containers.Includes = []string{}
+	cfg.Cgroup.Containers.Excludes = []string{}
+	cfg.Cgroup.Units.Includes = []string{}
+	cfg.Cgroup.Units.Excludes = []string{}
+	cfg.Port.Excludes = []string{}
+	cfg.Port.Peers = []PeerConfig{}
+	cfg.Client.Aggregate = AggregateByAddress
+	cfg.Client.IPv4Prefix = 24
+	cfg.Client.IPv6Prefix = 64
+	cfg.Client.Services = []ServiceConfig{}
+
+	return cfg
+}
+
+// agent.traffic_mode 的取值
+const (
+	TrafficByPort   = "port"
+	TrafficByCgroup = "cgroup"
+)
+
+// Duration 在配置里写成 10s、1m 这样的字符串
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	err := unmarshal(&s)
+	if err != nil {
+		return err
+	}
+
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
 }
 
 type ConfigLoader interface {
 	Load() error
 }
 
+// HttpConfigLoader 从配置服务器读取配置，放到layer里。
+// 用ETag避免重复下载，读到的配置检查没问题才覆盖原来的，并且存一份到本地，
+// 下次启动时服务器连不上可以用 FileConfigLoader 读这份缓存
 type HttpConfigLoader struct {
 	httpClient *http.Client
 	configUrl  string
-	config     *Config
+	layer      *Layer
+	// 上次成功读到的配置的ETag
+	etag string
+	// 本地缓存文件，为空表示不缓存
+	cacheFile string
+	// 替换layer之前检查新的值，为nil时不检查
+	check func(map[string]interface{}) error
 }
 
-func NewHttpConfigLoader(url string, cfg *Config) *HttpConfigLoader {
+func NewHttpConfigLoader(url string, timeout time.Duration, cacheFile string, layer *Layer) *HttpConfigLoader {
 	return &HttpConfigLoader{
-		httpClient: &http.Client{},
-		config:     cfg,
+		httpClient: &http.Client{Timeout: timeout},
+		layer:      layer,
 		configUrl:  url,
+		cacheFile:  cacheFile,
 	}
 }
 
+// SetCheck 设置替换layer之前怎么检查新的值，一般是 Layers.Check，要和别的层合并起来才知道对不对。
+// 检查不通过的配置不会放进layer，不记ETag，也不写缓存
+func (cl *HttpConfigLoader) SetCheck(check func(map[string]interface{}) error) {
+	cl.check = check
+}
+
+// Load 读取配置。服务器返回304时配置不变。出错时原来的配置不变
 func (cl *HttpConfigLoader) Load() error {
-	resp, err := cl.httpClient.Get(cl.configUrl)
+	req, err := http.NewRequest("GET", cl.configUrl, nil)
+	if err != nil {
+		return err
+	}
+	if cl.etag != "" {
+		req.Header.Set("If-None-Match", cl.etag)
+	}
+
+	resp, err := cl.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	dec := json.NewDecoder(resp.Body)
-	err = dec.Decode(cl.config)
-	if err == nil {
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s failed: %s", cl.configUrl, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	// 服务器上的配置可能比这个版本新，不认识的字段忽略掉
+	values, err := decodeLayer(data, ".json", false)
+	if err != nil {
+		return fmt.Errorf("decode %s failed: %s", cl.configUrl, err)
+	}
+	if cl.check != nil {
+		if err := cl.check(values); err != nil {
+			return fmt.Errorf("check %s failed: %s", cl.configUrl, err)
+		}
+	}
 
-type DefaultConfigLoader struct {
-	config *Config
-}
+	cl.layer.Set(values, cl.configUrl)
+	cl.etag = resp.Header.Get("ETag")
+
+	if cl.cacheFile != "" {
+		err = writeCache(cl.cacheFile, values)
+		if err != nil {
+			log.Printf("write config cache %s failed: %s\n", cl.cacheFile, err)
+		}
+	}
 
-func NewDefaultConfigLoader(cfg *Config) *DefaultConfigLoader {
-	return &DefaultConfigLoader{cfg}
+	return nil
 }
 
-func (cl *DefaultConfigLoader) Load() error {
-	if cl.config == nil {
-		return nil
+// writeCache 先写到临时文件再rename，免得写到一半时被读到。只写服务器上有的字段
+func writeCache(path string, values map[string]interface{}) error {
+	data, err := json.MarshalIndent(unflatten(values), "", "    ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
 	}
 
-	cl.config.Command.Includes = nil
-	cl.config.Command.Excludes = nil
-	cl.config.Port.Excludes = nil
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	return os.Rename(tmp, path)
 }
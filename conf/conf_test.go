@@ -2,7 +2,13 @@ package conf
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestDecodeConfig(t *testing.T) {
@@ -37,3 +43,121 @@ func TestDecodeConfig(t *testing.T) {
 		t.Errorf("%v\n", cfg)
 	}
 }
+
+func TestHttpConfigLoader(t *testing.T) {
+	body := `{"command": {"includes": ["service_box.*"]}}`
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	dir, _ := ioutil.TempDir("", "monclient")
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "cache", "config.json")
+
+	layer := NewLayer("http")
+	l := NewHttpConfigLoader(srv.URL, time.Second, cache, layer)
+	if err := l.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := mergeLayer(t, layer); len(cfg.Command.Includes) != 1 {
+		t.Errorf("%v", cfg)
+	}
+	if layer.Source() != "http "+srv.URL {
+		t.Error(layer.Source())
+	}
+
+	// 没变化时返回304，配置不动
+	if err := l.Load(); err != nil || requests != 2 || len(mergeLayer(t, layer).Command.Includes) != 1 {
+		t.Errorf("%s %d %v", err, requests, layer.Values())
+	}
+
+	// 缓存可以直接用FileConfigLoader读
+	cached := NewLayer("cache")
+	if err := NewFileConfigLoader(cache, cached).Load(); err != nil || mergeLayer(t, cached).Command.Includes[0] != "service_box.*" {
+		t.Errorf("%s %v", err, cached.Values())
+	}
+}
+
+func TestHttpConfigLoaderKeepOld(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	layer := NewLayer("http")
+	layer.Set(map[string]interface{}{"command.includes": []interface{}{"old"}}, "")
+	l := NewHttpConfigLoader(srv.URL, time.Second, "", layer)
+
+	for _, body = range []string{`{"command": `, `{"command": {"includes": ["(bad"]}}`} {
+		if err := l.Load(); err == nil {
+			t.Errorf("should fail: %s", body)
+		}
+		if cfg := mergeLayer(t, layer); cfg.Command.Includes[0] != "old" {
+			t.Errorf("%v", cfg)
+		}
+	}
+}
+
+func TestHttpConfigLoaderCheck(t *testing.T) {
+	etags := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etags = append(etags, r.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"agent": {"traffic_mode": "cgroup"}}`))
+	}))
+	defer srv.Close()
+
+	dir, _ := ioutil.TempDir("", "monclient")
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "config.json")
+
+	// 和别的层合起来不对
+	layer := NewLayer("http")
+	layer.Set(map[string]interface{}{"command.includes": []interface{}{"old"}}, "")
+	bad := NewLayer("flag")
+	bad.Set(map[string]interface{}{"command.includes": []interface{}{"(bad"}}, "")
+	layers := Layers{DefaultLayer(), layer, bad}
+
+	l := NewHttpConfigLoader(srv.URL, time.Second, cache, layer)
+	l.SetCheck(func(values map[string]interface{}) error {
+		return layers.Check(layer, values)
+	})
+	if err := l.Load(); err == nil {
+		t.Fatal("should fail")
+	}
+	if cfg := mergeLayer(t, layer); cfg.Command.Includes[0] != "old" || cfg.Agent.TrafficMode != TrafficByPort {
+		t.Errorf("%v", cfg)
+	}
+	if _, err := os.Stat(cache); err == nil {
+		t.Error("should not write cache")
+	}
+
+	// 别的层改好以后再读，不能因为记了ETag而拿到304
+	bad.Set(map[string]interface{}{}, "")
+	if err := l.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(etags) != 2 || etags[1] != "" || mergeLayer(t, layer).Agent.TrafficMode != TrafficByCgroup {
+		t.Errorf("%v %v", etags, layer.Values())
+	}
+}
+
+func TestHttpConfigLoaderTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	if err := NewHttpConfigLoader(srv.URL, 50*time.Millisecond, "", NewLayer("http")).Load(); err == nil {
+		t.Error("should time out")
+	}
+}
@@ -0,0 +1,174 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wanghengwei/monclient/filenotify"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FileConfigLoader 从本地文件读取配置，放到layer里。后缀是 .yaml 或 .yml 的按YAML解析，其它的按JSON解析
+type FileConfigLoader struct {
+	path  string
+	layer *Layer
+}
+
+func NewFileConfigLoader(path string, layer *Layer) *FileConfigLoader {
+	return &FileConfigLoader{
+		path:  path,
+		layer: layer,
+	}
+}
+
+// Load 读取并检查配置，都没问题才覆盖layer里原来的配置。出错时原来的配置不变
+func (cl *FileConfigLoader) Load() error {
+	data, err := ioutil.ReadFile(cl.path)
+	if err != nil {
+		return err
+	}
+
+	values, err := decodeLayer(data, filepath.Ext(cl.path), true)
+	if err != nil {
+		if _, ok := err.(*ValidationError); ok {
+			return err
+		}
+		return fmt.Errorf("decode %s failed: %s", cl.path, err)
+	}
+
+	cl.layer.Set(values, cl.path)
+	return nil
+}
+
+// Watch 监视配置文件，文件有变化时调用onChange。不会返回，除非一开始就加不上监视
+func (cl *FileConfigLoader) Watch(w filenotify.FileWatcher, onChange func()) error {
+	err := w.Add(cl.path)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case ev, ok := <-w.Events():
+			if !ok {
+				return nil
+			}
+
+			// 很多编辑器保存时是先写一个新文件再rename过来，原来的监视就失效了，要重新加上
+			if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				w.Remove(cl.path)
+				if err := cl.rewatch(w); err != nil {
+					log.Printf("watch config file %s failed: %s\n", cl.path, err)
+					continue
+				}
+			}
+
+			onChange()
+		case err, ok := <-w.Errors():
+			if !ok {
+				return nil
+			}
+			log.Printf("watch config file %s failed: %s\n", cl.path, err)
+		}
+	}
+}
+
+// rewatch 文件被替换时新文件可能还没出现，多试几次
+func (cl *FileConfigLoader) rewatch(w filenotify.FileWatcher) error {
+	var err error
+	for i := 0; i < 10; i++ {
+		err = w.Add(cl.path)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return err
+}
+
+// decodeLayer 解析并检查一份配置，返回里面写了的字段。
+// strict 时不认识的字段当成错误，免得写错了名字没发现
+func decodeLayer(data []byte, ext string, strict bool) (map[string]interface{}, error) {
+	var cfg Config
+	var raw map[string]interface{}
+
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		var err error
+		if strict {
+			err = yaml.UnmarshalStrict(data, &cfg)
+		} else {
+			err = yaml.Unmarshal(data, &cfg)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var doc map[interface{}]interface{}
+		err = yaml.Unmarshal(data, &doc)
+		if err != nil {
+			return nil, err
+		}
+		raw, _ = fromYAML(doc).(map[string]interface{})
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		if strict {
+			dec.DisallowUnknownFields()
+		}
+		err := dec.Decode(&cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(data, &raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	values := flatten(raw)
+	if !strict {
+		// 只留认识的字段
+		known := settingDefaults()
+		for k := range values {
+			if _, ok := known[k]; !ok && k != "rules" && k != "groups" {
+				delete(values, k)
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// fromYAML 把yaml解析出来的 map[interface{}]interface{} 转成和JSON一样的 map[string]interface{}
+func fromYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, item := range v {
+			m[fmt.Sprint(k)] = fromYAML(item)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			l[i] = fromYAML(item)
+		}
+		return l
+	default:
+		return v
+	}
+}
@@ -0,0 +1,128 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wanghengwei/monclient/filenotify"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mergeLayer 把一层配置和默认值合并
+func mergeLayer(t *testing.T, l *Layer) *Config {
+	cfg, _, err := Layers{DefaultLayer(), l}.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cfg
+}
+
+func TestFileConfigLoaderJSON(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "monclient")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	writeFile(t, path, `{"command": {"includes": ["service_box.*"]}, "port": {"excludes": ["27151-27955"]}}`)
+
+	layer := NewLayer("file")
+	err := NewFileConfigLoader(path, layer).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := mergeLayer(t, layer)
+	if len(cfg.Command.Includes) != 1 || cfg.Command.Includes[0] != "service_box.*" || cfg.Port.Excludes[0] != "27151-27955" {
+		t.Errorf("%v", cfg)
+	}
+}
+
+func TestFileConfigLoaderYAML(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "monclient")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	writeFile(t, path, "command:\n  includes:\n    - service_box.*\nx51log:\n  folder: /tmp\n")
+
+	layer := NewLayer("file")
+	err := NewFileConfigLoader(path, layer).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := mergeLayer(t, layer)
+	if len(cfg.Command.Includes) != 1 || cfg.X51Log.Folder != "/tmp" {
+		t.Errorf("%v", cfg)
+	}
+}
+
+func TestFileConfigLoaderKeepOld(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "monclient")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	layer := NewLayer("file")
+	layer.Set(map[string]interface{}{"command.includes": []interface{}{"old"}}, "")
+	l := NewFileConfigLoader(path, layer)
+
+	for _, content := range []string{
+		`{"command": {"includes": ["(bad"]}}`,
+		`{"include_patterns": ["server"]}`,
+		`{"command": `,
+	} {
+		writeFile(t, path, content)
+		if err := l.Load(); err == nil {
+			t.Errorf("should fail: %s", content)
+		}
+		if cfg := mergeLayer(t, layer); cfg.Command.Includes[0] != "old" {
+			t.Errorf("%v", cfg)
+		}
+	}
+}
+
+func TestFileConfigLoaderWatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "monclient")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	writeFile(t, path, `{}`)
+
+	changed := make(chan struct{}, 10)
+	go NewFileConfigLoader(path, NewLayer("file")).Watch(filenotify.NewPollingWatcher(), func() {
+		changed <- struct{}{}
+	})
+
+	// 等poller开始
+	time.Sleep(300 * time.Millisecond)
+	writeFile(t, path, `{"command": {"includes": ["a"]}}`)
+
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Error("no change notified")
+	}
+}
+
+func TestFileConfigLoaderGroups(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "monclient")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	writeFile(t, path, "groups:\n  - name: logic\n    command:\n      includes:\n        - service_box.*logic\n    user: game\n    smaps: true\n")
+
+	layer := NewLayer("file")
+	err := NewFileConfigLoader(path, layer).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := mergeLayer(t, layer)
+	if len(cfg.Groups) != 1 || cfg.Groups[0].Name != "logic" || cfg.Groups[0].User != "game" || !cfg.Groups[0].Smaps || cfg.Groups[0].Command.Includes[0] != "service_box.*logic" {
+		t.Errorf("%v", cfg)
+	}
+}
@@ -0,0 +1,161 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+// RuleBlock 一段只对匹配的主机生效的配置
+type RuleBlock struct {
+	Match HostSelector `json:"match" yaml:"match"`
+	// 为true时用这里的列表替换前面的，否则追加在后面。没写的列表不动。
+	// command.descendants 没法区分没写和false，所以这里只能打开
+	Override bool          `json:"override,omitempty" yaml:"override"`
+	Command  CommandConfig `json:"command" yaml:"command"`
+	Port     PortConfig    `json:"port" yaml:"port"`
+}
+
+// HostSelector 选择主机。写了的条件都要满足，什么都没写的匹配所有主机
+type HostSelector struct {
+	// 主机名的通配符，比如 gw-*，匹配其中一个就行
+	Hostnames []string `json:"hostnames,omitempty" yaml:"hostnames"`
+	// 主机的地址在其中一个网段里就行，比如 172.17.100.0/24
+	CIDRs []string `json:"cidrs,omitempty" yaml:"cidrs"`
+	// 主机的标签，要全部一样
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels"`
+}
+
+// Host 当前主机的信息，用来选择 RuleBlock
+type Host struct {
+	Hostname string
+	IPs      []net.IP
+	Labels   map[string]string
+}
+
+// LocalHost 获取本机的主机名和地址。labels 是启动时指定的标签
+func LocalHost(labels map[string]string) (*Host, error) {
+	name, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Host{
+		Hostname: name,
+		Labels:   labels,
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			h.IPs = append(h.IPs, ipnet.IP)
+		}
+	}
+
+	return h, nil
+}
+
+// ParseLabels 解析 k1=v1,k2=v2 形式的标签
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return labels, nil
+	}
+
+	for _, kv := range strings.Split(s, ",") {
+		ss := strings.SplitN(kv, "=", 2)
+		if len(ss) != 2 || strings.TrimSpace(ss[0]) == "" {
+			return nil, fmt.Errorf("bad label %q, should be key=value", kv)
+		}
+		labels[strings.TrimSpace(ss[0])] = strings.TrimSpace(ss[1])
+	}
+
+	return labels, nil
+}
+
+// Matches 判断主机是否满足条件。条件应当已经Validate过了，格式不对的条件不匹配
+func (s *HostSelector) Matches(h *Host) bool {
+	if len(s.Hostnames) > 0 {
+		matched := false
+		for _, pt := range s.Hostnames {
+			if ok, _ := path.Match(pt, h.Hostname); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(s.CIDRs) > 0 {
+		matched := false
+		for _, c := range s.CIDRs {
+			_, ipnet, err := net.ParseCIDR(c)
+			if err != nil {
+				continue
+			}
+			for _, ip := range h.IPs {
+				if ipnet.Contains(ip) {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for k, v := range s.Labels {
+		if h.Labels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ForHost 把匹配这个主机的 RuleBlock 按顺序合并进来，返回合并后的配置，里面不再有Rules
+func (c Config) ForHost(h *Host) Config {
+	rez := c
+	rez.Rules = nil
+	rez.Command.Includes = append([]string{}, c.Command.Includes...)
+	rez.Command.Excludes = append([]string{}, c.Command.Excludes...)
+	rez.Port.Excludes = append([]string{}, c.Port.Excludes...)
+	rez.Port.Peers = append([]PeerConfig{}, c.Port.Peers...)
+
+	for _, r := range c.Rules {
+		if !r.Match.Matches(h) {
+			continue
+		}
+
+		rez.Command.Includes = mergeList(rez.Command.Includes, r.Command.Includes, r.Override)
+		rez.Command.Excludes = mergeList(rez.Command.Excludes, r.Command.Excludes, r.Override)
+		rez.Port.Excludes = mergeList(rez.Port.Excludes, r.Port.Excludes, r.Override)
+		rez.Command.Descendants = rez.Command.Descendants || r.Command.Descendants
+		if r.Port.Peers != nil {
+			if r.Override {
+				rez.Port.Peers = nil
+			}
+			rez.Port.Peers = append(rez.Port.Peers, r.Port.Peers...)
+		}
+	}
+
+	return rez
+}
+
+func mergeList(base []string, more []string, override bool) []string {
+	if more == nil {
+		return base
+	}
+	if override {
+		return append([]string{}, more...)
+	}
+
+	return append(base, more...)
+}
@@ -0,0 +1,84 @@
+package conf
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+)
+
+const rulesConfig = `{
+	"command": {"includes": ["service_box.*"]},
+	"port": {"excludes": ["22"]},
+	"rules": [
+		{
+			"match": {"hostnames": ["gw-*"]},
+			"command": {"includes": ["gateway.*"], "descendants": true}
+		},
+		{
+			"match": {"cidrs": ["172.17.200.0/24"], "labels": {"role": "logic"}},
+			"override": true,
+			"port": {"excludes": ["27151-27955"]}
+		}
+	]
+}`
+
+func TestForHost(t *testing.T) {
+	var cfg Config
+	if err := json.Unmarshal([]byte(rulesConfig), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	gw := cfg.ForHost(&Host{Hostname: "gw-01", IPs: []net.IP{net.ParseIP("172.17.100.103")}})
+	if !reflect.DeepEqual(gw.Command.Includes, []string{"service_box.*", "gateway.*"}) || !reflect.DeepEqual(gw.Port.Excludes, []string{"22"}) || !gw.Command.Descendants {
+		t.Errorf("%v", gw)
+	}
+
+	logic := cfg.ForHost(&Host{
+		Hostname: "logic-01",
+		IPs:      []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("172.17.200.51")},
+		Labels:   map[string]string{"role": "logic"},
+	})
+	if !reflect.DeepEqual(logic.Command.Includes, []string{"service_box.*"}) || !reflect.DeepEqual(logic.Port.Excludes, []string{"27151-27955"}) || logic.Rules != nil || logic.Command.Descendants {
+		t.Errorf("%v", logic)
+	}
+
+	// 标签不对
+	other := cfg.ForHost(&Host{Hostname: "logic-02", IPs: []net.IP{net.ParseIP("172.17.200.52")}})
+	if !reflect.DeepEqual(other.Port.Excludes, []string{"22"}) {
+		t.Errorf("%v", other)
+	}
+
+	// 原来的配置没有被改
+	if len(cfg.Command.Includes) != 1 || len(cfg.Port.Excludes) != 1 {
+		t.Errorf("%v", cfg)
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	var cfg Config
+	cfg.Rules = []RuleBlock{{Match: HostSelector{Hostnames: []string{"[gw"}, CIDRs: []string{"172.17.200.0"}}}}
+	cfg.Rules[0].Command.Includes = []string{"(bad"}
+
+	ve, ok := cfg.Validate().(*ValidationError)
+	if !ok || len(ve.Problems) != 3 {
+		t.Fatalf("%v", ve)
+	}
+	if ve.Problems[1][:len("rules[0].match.cidrs[0]")] != "rules[0].match.cidrs[0]" {
+		t.Error(ve.Problems)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("role=gateway, zone=sh")
+	if err != nil || !reflect.DeepEqual(labels, map[string]string{"role": "gateway", "zone": "sh"}) {
+		t.Errorf("%v %s", labels, err)
+	}
+
+	if _, err := ParseLabels("role"); err == nil {
+		t.Error("should fail")
+	}
+}
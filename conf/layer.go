@@ -0,0 +1,373 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Layer 一层配置，只包含这一层写了的字段。
+// key 是字段在JSON里的路径，比如 command.includes、agent.listen_address，值和JSON解析出来的一样
+type Layer struct {
+	name string
+
+	mu     sync.Mutex
+	values map[string]interface{}
+	// 这一层的值具体是从哪来的，比如文件路径、url
+	origin string
+}
+
+// NewLayer 创建一个空的层
+func NewLayer(name string) *Layer {
+	return &Layer{
+		name:   name,
+		values: make(map[string]interface{}),
+	}
+}
+
+// DefaultLayer 包含所有默认值的层
+func DefaultLayer() *Layer {
+	l := NewLayer("default")
+	l.Set(settingDefaults(), "")
+	return l
+}
+
+// Set 替换这一层所有的值
+func (l *Layer) Set(values map[string]interface{}, origin string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.values = values
+	l.origin = origin
+}
+
+// Values 返回这一层的值
+func (l *Layer) Values() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rez := make(map[string]interface{}, len(l.values))
+	for k, v := range l.values {
+		rez[k] = v
+	}
+
+	return rez
+}
+
+// Source 这一层的名字，有来源的话带上来源，比如 file /etc/monclient.yaml
+func (l *Layer) Source() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.origin == "" {
+		return l.name
+	}
+
+	return l.name + " " + l.origin
+}
+
+// Layers 按优先级从低到高排列的配置，比如 default < file < http < env < flag
+type Layers []*Layer
+
+// Merge 合并所有层，后面的覆盖前面的。返回合并后的配置，以及每个字段最后来自哪一层
+func (ls Layers) Merge() (*Config, map[string]string, error) {
+	return ls.merge(nil, nil)
+}
+
+// Check 检查把 layer 的值换成 values 以后还能不能合并，layer 本身不变。
+// 换之前先检查，免得一层的新值和别的层合不到一起，以后每次合并都失败
+func (ls Layers) Check(layer *Layer, values map[string]interface{}) error {
+	_, _, err := ls.merge(layer, values)
+	return err
+}
+
+// merge 合并所有层，replace 不为nil时用 values 代替它的值
+func (ls Layers) merge(replace *Layer, replaced map[string]interface{}) (*Config, map[string]string, error) {
+	values := make(map[string]interface{})
+	sources := make(map[string]string)
+
+	for _, l := range ls {
+		source := l.Source()
+		lv := l.Values()
+		if l == replace {
+			lv = replaced
+		}
+		for k, v := range lv {
+			values[k] = v
+			sources[k] = source
+		}
+	}
+
+	cfg, err := decodeValues(values)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cfg, sources, nil
+}
+
+// Print 打印合并后的配置，每行一个字段，后面是它来自哪一层
+func (ls Layers) Print(w io.Writer) error {
+	_, sources, err := ls.Merge()
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]interface{})
+	for _, l := range ls {
+		for k, v := range l.Values() {
+			values[k] = v
+		}
+	}
+
+	keys := []string{}
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v, _ := json.Marshal(values[k])
+		fmt.Fprintf(w, "%s = %s  # %s\n", k, v, sources[k])
+	}
+
+	return nil
+}
+
+// EnvLayer 从环境变量读取配置。变量名见 settingName，比如 MONCLIENT_LISTEN_ADDRESS、MONCLIENT_COMMAND_INCLUDES。
+// 字符串的列表用逗号分隔，也可以直接写JSON数组；port.peers、client.services 这种对象的列表只能写JSON数组
+func EnvLayer(lookup func(string) (string, bool)) (*Layer, error) {
+	values := make(map[string]interface{})
+	for _, key := range settingKeys() {
+		env := "MONCLIENT_" + strings.ToUpper(settingName(key))
+		raw, ok := lookup(env)
+		if !ok {
+			continue
+		}
+
+		v, err := parseSetting(key, raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", env, err)
+		}
+		values[key] = v
+	}
+
+	l := NewLayer("env")
+	l.Set(values, "")
+	return l, nil
+}
+
+// FlagSettings 每个配置字段对应的命令行参数，比如 -listen-address、-command-includes
+type FlagSettings struct {
+	fs    *flag.FlagSet
+	names map[string]string
+}
+
+// RegisterFlags 把所有配置字段注册成命令行参数。要在 fs.Parse 之前调用。
+// bool的字段和普通的bool参数一样，只写 -rollup 就是true
+func RegisterFlags(fs *flag.FlagSet) *FlagSettings {
+	f := &FlagSettings{
+		fs:    fs,
+		names: make(map[string]string),
+	}
+
+	defaults := settingDefaults()
+	for _, key := range settingKeys() {
+		name := strings.Replace(settingName(key), "_", "-", -1)
+		usage := fmt.Sprintf("override config %s", key)
+		if _, ok := defaults[key].(bool); ok {
+			fs.Bool(name, false, usage)
+		} else {
+			fs.String(name, "", usage)
+		}
+		f.names[name] = key
+	}
+
+	return f
+}
+
+// Layer 返回命令行上指定了的配置
+func (f *FlagSettings) Layer() (*Layer, error) {
+	values := make(map[string]interface{})
+
+	var err error
+	f.fs.Visit(func(fl *flag.Flag) {
+		key, ok := f.names[fl.Name]
+		if !ok || err != nil {
+			return
+		}
+
+		var v interface{}
+		v, err = parseSetting(key, fl.Value.String())
+		if err != nil {
+			err = fmt.Errorf("-%s: %s", fl.Name, err)
+			return
+		}
+		values[key] = v
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l := NewLayer("flag")
+	l.Set(values, "")
+	return l, nil
+}
+
+// settingDefaults 默认配置里所有的字段。groups 和 rules 不在里面，它们只能写在配置文件或配置服务器上
+func settingDefaults() map[string]interface{} {
+	data, _ := json.Marshal(Defaults())
+
+	var raw map[string]interface{}
+	json.Unmarshal(data, &raw)
+
+	return flatten(raw)
+}
+
+func settingKeys() []string {
+	keys := []string{}
+	for k := range settingDefaults() {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// settingName 环境变量和命令行参数用的名字。agent下的字段直接用字段名，其它的带上段名，
+// 比如 listen_address、command_includes
+func settingName(key string) string {
+	return strings.Replace(strings.TrimPrefix(key, "agent."), ".", "_", -1)
+}
+
+// parseSetting 按默认值的类型解析环境变量或命令行上的值
+func parseSetting(key string, raw string) (interface{}, error) {
+	var v interface{}
+
+	switch settingDefaults()[key].(type) {
+	case []interface{}:
+		raw = strings.TrimSpace(raw)
+		if strings.HasPrefix(raw, "[") {
+			var l []interface{}
+			err := json.Unmarshal([]byte(raw), &l)
+			if err != nil {
+				return nil, err
+			}
+			v = l
+		} else {
+			// 对象的列表没法用逗号分隔，放一个字符串进去解析不了就是了
+			if _, err := decodeValues(map[string]interface{}{key: []interface{}{""}}); err != nil {
+				return nil, fmt.Errorf("should be a JSON array, comma separated values are only for lists of strings")
+			}
+			l := []interface{}{}
+			for _, s := range strings.Split(raw, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					l = append(l, s)
+				}
+			}
+			v = l
+		}
+	case float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, err
+		}
+		v = f
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, err
+		}
+		v = b
+	default:
+		v = raw
+	}
+
+	// 单独检查一下，出错时能知道是哪个字段
+	cfg, err := decodeValues(map[string]interface{}{key: v})
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// decodeValues 把各层合并后的值转成Config
+func decodeValues(values map[string]interface{}) (*Config, error) {
+	data, err := json.Marshal(unflatten(values))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// flatten 把嵌套的配置展开成 a.b.c 形式的key。列表不展开，null当成没写
+func flatten(raw map[string]interface{}) map[string]interface{} {
+	rez := make(map[string]interface{})
+
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+
+			switch v := v.(type) {
+			case nil:
+			case map[string]interface{}:
+				walk(key, v)
+			default:
+				rez[key] = v
+			}
+		}
+	}
+	walk("", raw)
+
+	return rez
+}
+
+// unflatten 是 flatten 反过来
+func unflatten(values map[string]interface{}) map[string]interface{} {
+	rez := make(map[string]interface{})
+
+	for key, v := range values {
+		parts := strings.Split(key, ".")
+		m := rez
+		for _, p := range parts[:len(parts)-1] {
+			sub, ok := m[p].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				m[p] = sub
+			}
+			m = sub
+		}
+		m[parts[len(parts)-1]] = v
+	}
+
+	return rez
+}
@@ -0,0 +1,165 @@
+package conf
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLayersMerge(t *testing.T) {
+	file := NewLayer("file")
+	file.Set(map[string]interface{}{
+		"agent.listen_address": ":9000",
+		"agent.snap_interval":  "5s",
+		"command.includes":     []interface{}{"service_box.*"},
+	}, "/etc/monclient.json")
+	http := NewLayer("http")
+	http.Set(map[string]interface{}{"agent.snap_interval": "30s"}, "http://cfg")
+	env := NewLayer("env")
+	env.Set(map[string]interface{}{"agent.listen_address": ":9100"}, "")
+
+	cfg, sources, err := Layers{DefaultLayer(), file, http, env}.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Agent.ListenAddress != ":9100" || time.Duration(cfg.Agent.SnapInterval) != 30*time.Second || cfg.Command.Includes[0] != "service_box.*" {
+		t.Errorf("%v", cfg)
+	}
+	if cfg.Agent.PidFile != "/tmp/monclient.pid" {
+		t.Errorf("%v", cfg)
+	}
+
+	for k, want := range map[string]string{
+		"agent.listen_address": "env",
+		"agent.snap_interval":  "http http://cfg",
+		"command.includes":     "file /etc/monclient.json",
+		"agent.pid_file":       "default",
+	} {
+		if sources[k] != want {
+			t.Errorf("%s: want %s, got %s", k, want, sources[k])
+		}
+	}
+}
+
+func TestLayersMergeInvalid(t *testing.T) {
+	env := NewLayer("env")
+	env.Set(map[string]interface{}{"agent.snap_interval": "-1s"}, "")
+
+	if _, _, err := (Layers{DefaultLayer(), env}).Merge(); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestEnvLayer(t *testing.T) {
+	envs := map[string]string{
+		"MONCLIENT_LISTEN_ADDRESS":   ":9200",
+		"MONCLIENT_COMMAND_INCLUDES": "a, b",
+		"MONCLIENT_PORT_EXCLUDES":    `["22", "1000-2000"]`,
+	}
+	l, err := EnvLayer(func(k string) (string, bool) {
+		v, ok := envs[k]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := mergeLayer(t, l)
+	if cfg.Agent.ListenAddress != ":9200" || len(cfg.Command.Includes) != 2 || cfg.Command.Includes[1] != "b" || cfg.Port.Excludes[1] != "1000-2000" {
+		t.Errorf("%v", cfg)
+	}
+
+	envs["MONCLIENT_SNAP_INTERVAL"] = "soon"
+	if _, err := EnvLayer(func(k string) (string, bool) {
+		v, ok := envs[k]
+		return v, ok
+	}); err == nil || !strings.Contains(err.Error(), "MONCLIENT_SNAP_INTERVAL") {
+		t.Errorf("%v", err)
+	}
+}
+
+func TestEnvLayerObjectList(t *testing.T) {
+	envs := map[string]string{"MONCLIENT_PORT_PEERS": "8080, 9090"}
+	lookup := func(k string) (string, bool) {
+		v, ok := envs[k]
+		return v, ok
+	}
+
+	_, err := EnvLayer(lookup)
+	if err == nil || !strings.Contains(err.Error(), "MONCLIENT_PORT_PEERS") || !strings.Contains(err.Error(), "should be a JSON array") {
+		t.Errorf("%v", err)
+	}
+
+	envs["MONCLIENT_PORT_PEERS"] = `[{"port": 8080, "top": 5}]`
+	l, err := EnvLayer(lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg := mergeLayer(t, l); len(cfg.Port.Peers) != 1 || cfg.Port.Peers[0].Top != 5 {
+		t.Errorf("%v", cfg)
+	}
+}
+
+func TestFlagSettings(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	settings := RegisterFlags(fs)
+	err := fs.Parse([]string{"-snap-interval", "1m", "-x51log-folder", "/data/log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := settings.Layer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 没写的参数不会覆盖下面的层
+	if len(l.Values()) != 2 {
+		t.Errorf("%v", l.Values())
+	}
+	cfg := mergeLayer(t, l)
+	if time.Duration(cfg.Agent.SnapInterval) != time.Minute || cfg.X51Log.Folder != "/data/log" || cfg.Agent.ListenAddress != ":10001" {
+		t.Errorf("%v", cfg)
+	}
+}
+
+func TestFlagSettingsBool(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	settings := RegisterFlags(fs)
+	err := fs.Parse([]string{"-rollup", "-cgroup-labels=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := settings.Layer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := l.Values(); len(v) != 2 || v["agent.rollup"] != true || v["agent.cgroup_labels"] != false {
+		t.Errorf("%v", v)
+	}
+}
+
+func TestLayersPrint(t *testing.T) {
+	env := NewLayer("env")
+	env.Set(map[string]interface{}{"agent.listen_address": ":9100"}, "")
+
+	out := bytes.Buffer{}
+	err := Layers{DefaultLayer(), env}.Print(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`agent.listen_address = ":9100"  # env`,
+		`agent.snap_interval = "10s"  # default`,
+		`command.includes = []  # default`,
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("missing %s in\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ValidationError 包含配置里的所有问题，每个问题前面是它在JSON里的路径，比如 command.includes[1]
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// PortRange 表示一段端口，单个端口的话 From 和 To 一样
+type PortRange struct {
+	From int
+	To   int
+}
+
+// Single 是否只有一个端口
+func (r PortRange) Single() bool {
+	return r.From == r.To
+}
+
+var portRangePattern = regexp.MustCompile(`^(\w[\w-]*?)-(\w[\w-]*)$`)
+
+// ParsePortSpec 解析端口配置。支持单个端口(8080)、范围(27151-27955)和服务名(ssh、http)，
+// 服务名按 /etc/services 查
+func ParsePortSpec(s string) (PortRange, error) {
+	s = strings.TrimSpace(s)
+
+	// 先整个当成一个端口或服务名，有的服务名里本身就带 -
+	port, err := parsePort(s)
+	if err == nil {
+		return PortRange{port, port}, nil
+	}
+
+	ms := portRangePattern.FindStringSubmatch(s)
+	if ms == nil {
+		return PortRange{}, err
+	}
+
+	from, err := parsePort(ms[1])
+	if err != nil {
+		return PortRange{}, err
+	}
+	to, err := parsePort(ms[2])
+	if err != nil {
+		return PortRange{}, err
+	}
+	if from > to {
+		return PortRange{}, fmt.Errorf("bad port range %q: %d > %d", s, from, to)
+	}
+
+	return PortRange{from, to}, nil
+}
+
+func parsePort(s string) (int, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty port")
+	}
+
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		port, err = net.LookupPort("tcp", s)
+		if err != nil {
+			return 0, fmt.Errorf("unknown port %q", s)
+		}
+	}
+
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range", port)
+	}
+
+	return port, nil
+}
+
+// ExcludedPorts 返回不需要统计的端口。配置应当已经Validate过了，解析不了的会被跳过
+func (c *Config) ExcludedPorts() []PortRange {
+	rez := []PortRange{}
+	for _, s := range c.Port.Excludes {
+		r, err := ParsePortSpec(s)
+		if err == nil {
+			rez = append(rez, r)
+		}
+	}
+
+	return rez
+}
+
+// Validate 检查配置是否能用：进程的正则表达式能编译，端口都能解析，组名不重复，主机的条件格式正确。
+// 不会在第一个问题就停下，所有的问题都放在 *ValidationError 里返回
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.agent(&c.Agent)
+	v.command("command", &c.Command)
+	v.patterns("cgroup.containers", &c.Cgroup.Containers)
+	v.patterns("cgroup.units", &c.Cgroup.Units)
+	v.port("port", &c.Port)
+	v.client(&c.Client)
+
+	names := make(map[string]bool)
+	for i, g := range c.Groups {
+		prefix := fmt.Sprintf("groups[%d]", i)
+		if g.Name == "" {
+			v.addField(prefix+".name", fmt.Errorf("should not be empty"))
+		} else if names[g.Name] {
+			v.addField(prefix+".name", fmt.Errorf("duplicated group %q", g.Name))
+		}
+		names[g.Name] = true
+
+		v.command(prefix+".command", &g.Command)
+		if g.Cgroup != "" {
+			if _, err := regexp.Compile(g.Cgroup); err != nil {
+				v.addField(prefix+".cgroup", err)
+			}
+		}
+	}
+
+	for i, r := range c.Rules {
+		prefix := fmt.Sprintf("rules[%d]", i)
+		for j, pt := range r.Match.Hostnames {
+			if _, err := path.Match(pt, ""); err != nil {
+				v.add(prefix+".match.hostnames", j, err)
+			}
+		}
+		for j, cidr := range r.Match.CIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				v.add(prefix+".match.cidrs", j, err)
+			}
+		}
+		v.command(prefix+".command", &r.Command)
+		v.port(prefix+".port", &r.Port)
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+
+	return nil
+}
+
+// validator 收集问题
+type validator struct {
+	problems []string
+}
+
+func (v *validator) add(path string, i int, err error) {
+	v.problems = append(v.problems, fmt.Sprintf("%s[%d]: %s", path, i, err))
+}
+
+func (v *validator) addField(path string, err error) {
+	v.problems = append(v.problems, fmt.Sprintf("%s: %s", path, err))
+}
+
+// agent 没写的字段会用默认值，所以空的不算错
+func (v *validator) agent(c *AgentConfig) {
+	if c.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+			v.addField("agent.listen_address", err)
+		}
+	}
+	if c.SnapInterval < 0 {
+		v.addField("agent.snap_interval", fmt.Errorf("should not be negative"))
+	}
+	if c.RestartWindow < 0 {
+		v.addField("agent.restart_window", fmt.Errorf("should not be negative"))
+	}
+	if c.TrafficMode != "" && c.TrafficMode != TrafficByPort && c.TrafficMode != TrafficByCgroup {
+		v.addField("agent.traffic_mode", fmt.Errorf("should be %s or %s", TrafficByPort, TrafficByCgroup))
+	}
+	if c.ConfigURL != "" {
+		u, err := url.Parse(c.ConfigURL)
+		if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+			err = fmt.Errorf("should be a http or https url")
+		}
+		if err != nil {
+			v.addField("agent.config_url", err)
+		}
+	}
+}
+
+func (v *validator) command(prefix string, c *CommandConfig) {
+	v.patterns(prefix, &PatternConfig{Includes: c.Includes, Excludes: c.Excludes})
+}
+
+func (v *validator) patterns(prefix string, c *PatternConfig) {
+	for i, pt := range c.Includes {
+		if _, err := regexp.Compile(pt); err != nil {
+			v.add(prefix+".includes", i, err)
+		}
+	}
+	for i, pt := range c.Excludes {
+		if _, err := regexp.Compile(pt); err != nil {
+			v.add(prefix+".excludes", i, err)
+		}
+	}
+}
+
+// client 没写的字段会用默认值，所以aggregate为空、前缀长度为0不算错
+func (v *validator) client(c *ClientConfig) {
+	switch c.Aggregate {
+	case "", AggregateByAddress, AggregateByPort, AggregateByCIDR, AggregateByService:
+	default:
+		v.addField("client.aggregate", fmt.Errorf("should be one of %s, %s, %s, %s", AggregateByAddress, AggregateByPort, AggregateByCIDR, AggregateByService))
+	}
+
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 {
+		v.addField("client.ipv4_prefix", fmt.Errorf("should be in [0, 32]"))
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		v.addField("client.ipv6_prefix", fmt.Errorf("should be in [0, 128]"))
+	}
+
+	for i, svc := range c.Services {
+		prefix := fmt.Sprintf("client.services[%d]", i)
+		if svc.Name == "" {
+			v.addField(prefix+".name", fmt.Errorf("should not be empty"))
+		}
+		for j, cidr := range svc.CIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				v.add(prefix+".cidrs", j, err)
+			}
+		}
+	}
+}
+
+func (v *validator) port(prefix string, c *PortConfig) {
+	for i, s := range c.Excludes {
+		if _, err := ParsePortSpec(s); err != nil {
+			v.add(prefix+".excludes", i, err)
+		}
+	}
+
+	ports := make(map[int]bool)
+	for i, p := range c.Peers {
+		path := fmt.Sprintf("%s.peers[%d]", prefix, i)
+		switch {
+		case p.Port < 1 || p.Port > 65535:
+			v.addField(path+".port", fmt.Errorf("port %d out of range", p.Port))
+		case ports[p.Port]:
+			v.addField(path+".port", fmt.Errorf("duplicated port %d", p.Port))
+		}
+		ports[p.Port] = true
+
+		if p.Top < 0 {
+			v.addField(path+".top", fmt.Errorf("should not be negative"))
+		}
+		if p.MaxTracked < 0 {
+			v.addField(path+".max_tracked", fmt.Errorf("should not be negative"))
+		} else if p.MaxTracked > 0 && p.MaxTracked < p.Top {
+			v.addField(path+".max_tracked", fmt.Errorf("should not be less than top"))
+		}
+	}
+}
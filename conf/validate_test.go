@@ -0,0 +1,135 @@
+package conf
+
+import (
+	"testing"
+)
+
+func TestParsePortSpec(t *testing.T) {
+	for s, want := range map[string]PortRange{
+		"8080":        {8080, 8080},
+		"27151-27955": {27151, 27955},
+		"ssh":         {22, 22},
+		"http-https":  {80, 443},
+	} {
+		r, err := ParsePortSpec(s)
+		if err != nil || r != want {
+			t.Errorf("%s: %v %s", s, r, err)
+		}
+	}
+
+	for _, s := range []string{"", "0", "70000", "3000-2000", "no-such-service", "1-2-3"} {
+		if _, err := ParsePortSpec(s); err == nil {
+			t.Errorf("should fail: %q", s)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var cfg Config
+	cfg.Command.Includes = []string{"service_box.*", "(bad"}
+	cfg.Command.Excludes = []string{"[bad"}
+	cfg.Port.Excludes = []string{"22", "3000-2000"}
+	cfg.Agent.TrafficMode = "ebpf"
+
+	err := cfg.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok || len(ve.Problems) != 4 {
+		t.Fatalf("%v", err)
+	}
+
+	for i, prefix := range []string{"agent.traffic_mode: ", "command.includes[1]: ", "command.excludes[0]: ", "port.excludes[1]: "} {
+		if len(ve.Problems[i]) < len(prefix) || ve.Problems[i][:len(prefix)] != prefix {
+			t.Errorf("%s", ve.Problems[i])
+		}
+	}
+
+	cfg.Command.Includes = cfg.Command.Includes[:1]
+	cfg.Command.Excludes = nil
+	cfg.Port.Excludes = cfg.Port.Excludes[:1]
+	cfg.Agent.TrafficMode = TrafficByCgroup
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateGroups(t *testing.T) {
+	var cfg Config
+	cfg.Groups = []GroupConfig{
+		{Name: "logic", Cgroup: `game-logic\.service$`},
+		{Name: "logic"},
+		{Command: CommandConfig{Includes: []string{"(bad"}}, Cgroup: "[bad"},
+	}
+
+	err := cfg.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok || len(ve.Problems) != 4 {
+		t.Fatalf("%v", err)
+	}
+
+	for i, prefix := range []string{"groups[1].name: ", "groups[2].name: ", "groups[2].command.includes[0]: ", "groups[2].cgroup: "} {
+		if len(ve.Problems[i]) < len(prefix) || ve.Problems[i][:len(prefix)] != prefix {
+			t.Errorf("%s", ve.Problems[i])
+		}
+	}
+}
+
+func TestValidateCgroup(t *testing.T) {
+	var cfg Config
+	cfg.Cgroup.Containers.Includes = []string{"^3f2a", "(bad"}
+	cfg.Cgroup.Units.Excludes = []string{"[bad"}
+
+	err := cfg.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok || len(ve.Problems) != 2 {
+		t.Fatalf("%v", err)
+	}
+
+	for i, prefix := range []string{"cgroup.containers.includes[1]: ", "cgroup.units.excludes[0]: "} {
+		if len(ve.Problems[i]) < len(prefix) || ve.Problems[i][:len(prefix)] != prefix {
+			t.Errorf("%s", ve.Problems[i])
+		}
+	}
+}
+
+func TestValidateClient(t *testing.T) {
+	var cfg Config
+	cfg.Client.Aggregate = "host"
+	cfg.Client.IPv4Prefix = 33
+	cfg.Client.Services = []ServiceConfig{
+		{Name: "mysql", CIDRs: []string{"10.1.0.0/16", "10.2.0.0"}},
+		{CIDRs: []string{"2001:db8::/32"}},
+	}
+
+	err := cfg.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok || len(ve.Problems) != 4 {
+		t.Fatalf("%v", err)
+	}
+
+	for i, prefix := range []string{"client.aggregate: ", "client.ipv4_prefix: ", "client.services[0].cidrs[1]: ", "client.services[1].name: "} {
+		if len(ve.Problems[i]) < len(prefix) || ve.Problems[i][:len(prefix)] != prefix {
+			t.Errorf("%s", ve.Problems[i])
+		}
+	}
+}
+
+func TestValidatePeers(t *testing.T) {
+	var cfg Config
+	cfg.Port.Peers = []PeerConfig{
+		{Port: 8080, Top: 5},
+		{Port: 8080},
+		{Port: 70000, Top: 20, MaxTracked: 10},
+	}
+
+	err := cfg.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok || len(ve.Problems) != 3 {
+		t.Fatalf("%v", err)
+	}
+
+	for i, prefix := range []string{"port.peers[1].port: ", "port.peers[2].port: ", "port.peers[2].max_tracked: "} {
+		if len(ve.Problems[i]) < len(prefix) || ve.Problems[i][:len(prefix)] != prefix {
+			t.Errorf("%s", ve.Problems[i])
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package exporter
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/wanghengwei/monclient/proc"
+)
+
+const namespace = "x51"
+
+// Monitor 提供进程的快照。ProcessMonitor 应用上配置以后就是一个Monitor，测试时可以换成假的
+type Monitor interface {
+	// Snap 采集一次，返回所有匹配的进程
+	Snap() ([]*proc.Proc, error)
+	// Events 最近一次Snap和上一次相比，进程的启动、退出、重启
+	Events() []proc.Event
+	// Cgroups 最近一次Snap时记录的进程所在的unit、容器的cgroup资源用量
+	Cgroups() []*proc.Cgroup
+	// CgroupTraffic 最近一次Snap按cgroup统计的发出流量
+	CgroupTraffic() []*proc.CgroupTraffic
+	// TrafficRuleFailures 累计有多少条流量统计规则没能创建或删除
+	TrafficRuleFailures() uint64
+}
+
+// Collector 把Monitor的快照导出成prometheus的指标。
+// 采集由抓取驱动：距上次采集不到maxAge时直接用缓存的结果，这样抓取频率决定了数据有多新，
+// 多个抓取同时来也只会采集一次
+type Collector struct {
+	monitor Monitor
+	maxAge  time.Duration
+	now     func() time.Time
+
+	mu       sync.Mutex
+	lastSnap time.Time
+	series   *seriesStore
+	counters *groupCounters
+	// 是否导出进程树的汇总
+	rollup bool
+	// 累计的进程生命周期事件数
+	lifecycle map[lifecycleKey]uint64
+	// 进程的指标是否带container和unit标签
+	cgroupLabels bool
+
+	cpu                *prometheus.Desc
+	mem                *prometheus.Desc
+	rss                *prometheus.Desc
+	shared             *prometheus.Desc
+	data               *prometheus.Desc
+	swap               *prometheus.Desc
+	pss                *prometheus.Desc
+	uss                *prometheus.Desc
+	ioReadChars        *prometheus.Desc
+	ioWriteChars       *prometheus.Desc
+	ioReadSyscalls     *prometheus.Desc
+	ioWriteSyscalls    *prometheus.Desc
+	ioReadBytes        *prometheus.Desc
+	ioWriteBytes       *prometheus.Desc
+	openFDs            *prometheus.Desc
+	maxFDs             *prometheus.Desc
+	threads            *prometheus.Desc
+	ctxtSwitches       *prometheus.Desc
+	startTime          *prometheus.Desc
+	uptime             *prometheus.Desc
+	netRecvBytes       *prometheus.Desc
+	netRecvPackets     *prometheus.Desc
+	netRecvPeerBytes   *prometheus.Desc
+	netRecvPeerPackets *prometheus.Desc
+	netSendFromBytes   *prometheus.Desc
+	netSendFromPackets *prometheus.Desc
+	netSendToBytes     *prometheus.Desc
+	netSendToPackets   *prometheus.Desc
+	ruleFailures       *prometheus.Desc
+	starts             *prometheus.Desc
+	exits              *prometheus.Desc
+	restarts           *prometheus.Desc
+	cgroupCPU          *prometheus.Desc
+	cgroupMemory       *prometheus.Desc
+	cgroupPIDs         *prometheus.Desc
+	cgroupReadBytes    *prometheus.Desc
+	cgroupWriteBytes   *prometheus.Desc
+	cgroupReads        *prometheus.Desc
+	cgroupWrites       *prometheus.Desc
+	cgroupSendBytes    *prometheus.Desc
+	cgroupSendPackets  *prometheus.Desc
+
+	// 按组汇总的指标
+	group aggregateDescs
+	// 每个进程连同子孙进程汇总的指标
+	tree aggregateDescs
+}
+
+// aggregateDescs 汇总多个进程的指标
+type aggregateDescs struct {
+	procs              *prometheus.Desc
+	cpu                *prometheus.Desc
+	mem                *prometheus.Desc
+	rss                *prometheus.Desc
+	netRecvBytes       *prometheus.Desc
+	netRecvPackets     *prometheus.Desc
+	netSendFromBytes   *prometheus.Desc
+	netSendFromPackets *prometheus.Desc
+	netSendToBytes     *prometheus.Desc
+	netSendToPackets   *prometheus.Desc
+}
+
+func newAggregateDescs(desc func(string, string, []string) *prometheus.Desc, prefix string, of string, labels []string) aggregateDescs {
+	return aggregateDescs{
+		procs:              desc(prefix+"_processes", "Number of processes in "+of, labels),
+		cpu:                desc(prefix+"_cpu_usage", "CPU Usage of "+of, labels),
+		mem:                desc(prefix+"_mem_virt", "Memory Usage of "+of, labels),
+		rss:                desc(prefix+"_mem_rss", "Resident Memory of "+of, labels),
+		netRecvBytes:       desc(prefix+"_net_recv_bytes_total", "Received Bytes of "+of, labels),
+		netRecvPackets:     desc(prefix+"_net_recv_packets_total", "Received Packets of "+of, labels),
+		netSendFromBytes:   desc(prefix+"_net_sendfrom_bytes_total", "send bytes from local ports of "+of, labels),
+		netSendFromPackets: desc(prefix+"_net_sendfrom_packets_total", "send packets from local ports of "+of, labels),
+		netSendToBytes:     desc(prefix+"_net_sendto_bytes_total", "send bytes to remote addresses from "+of, labels),
+		netSendToPackets:   desc(prefix+"_net_sendto_packets_total", "send packets to remote addresses from "+of, labels),
+	}
+}
+
+func (d *aggregateDescs) all() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		d.procs, d.cpu, d.mem, d.rss,
+		d.netRecvBytes, d.netRecvPackets, d.netSendFromBytes, d.netSendFromPackets,
+		d.netSendToBytes, d.netSendToPackets,
+	}
+}
+
+// NewCollector 创建一个Collector。grace 是进程退出、连接关闭以后指标还保留多久
+func NewCollector(m Monitor, maxAge time.Duration, grace time.Duration) *Collector {
+	c := &Collector{
+		monitor:   m,
+		maxAge:    maxAge,
+		now:       time.Now,
+		series:    newSeriesStore(grace),
+		counters:  newGroupCounters(grace),
+		lifecycle: make(map[lifecycleKey]uint64),
+	}
+	c.initDescs()
+
+	return c
+}
+
+// EnableCgroupLabels 给每个进程的指标加上container和unit标签。标签变了指标就不一样了，要在注册之前调用
+func (c *Collector) EnableCgroupLabels() {
+	c.cgroupLabels = true
+	c.initDescs()
+}
+
+// procValues 每个进程的指标都有的标签值，和initDescs里的procLabels对应
+func (c *Collector) procValues(p *proc.Proc) []string {
+	values := []string{p.Group, p.Command, strconv.Itoa(p.PID)}
+	if c.cgroupLabels {
+		values = append(values, p.ContainerID, p.Unit)
+	}
+
+	return values
+}
+
+// initDescs 创建所有指标的描述，进程的指标按cgroupLabels决定带不带container和unit标签
+func (c *Collector) initDescs() {
+	procLabels := []string{"group", "cmd", "pid"}
+	if c.cgroupLabels {
+		procLabels = append(procLabels, "container", "unit")
+	}
+	with := func(more ...string) []string {
+		return append(append([]string{}, procLabels...), more...)
+	}
+
+	ctxtLabels := with("type")
+	listenLabels := with("port", "family", "protocol")
+	peerLabels := with("port", "family", "protocol", "peer")
+	clientLabels := with("addr", "port", "family", "protocol")
+	treeLabels := procLabels
+	groupLabels := []string{"group"}
+	lifecycleLabels := []string{"group", "cmd"}
+	cgroupLabels := []string{"group", "cgroup", "container", "unit"}
+
+	desc := func(name string, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+	}
+
+	c.cpu = desc("cpu_usage", "CPU Usage", procLabels)
+	c.mem = desc("mem_virt", "Memory Usage", procLabels)
+	c.rss = desc("mem_rss", "Resident Memory", procLabels)
+	c.shared = desc("mem_shared", "Resident Memory shared with other processes", procLabels)
+	c.data = desc("mem_data", "Data and Stack Memory", procLabels)
+	c.swap = desc("mem_swap", "Swapped out Memory", procLabels)
+	c.pss = desc("mem_pss", "Proportional Set Size, only for groups reading smaps", procLabels)
+	c.uss = desc("mem_uss", "Unique Set Size, only for groups reading smaps", procLabels)
+	c.ioReadChars = desc("io_read_chars_total", "Bytes read by read syscalls, including page cache", procLabels)
+	c.ioWriteChars = desc("io_write_chars_total", "Bytes written by write syscalls, including page cache", procLabels)
+	c.ioReadSyscalls = desc("io_read_syscalls_total", "Count of read syscalls", procLabels)
+	c.ioWriteSyscalls = desc("io_write_syscalls_total", "Count of write syscalls", procLabels)
+	c.ioReadBytes = desc("io_read_bytes_total", "Bytes read from storage", procLabels)
+	c.ioWriteBytes = desc("io_write_bytes_total", "Bytes written to storage", procLabels)
+	c.openFDs = desc("open_fds", "Number of open file descriptors", procLabels)
+	c.maxFDs = desc("max_fds", "Soft limit of open file descriptors", procLabels)
+	c.threads = desc("threads", "Number of threads", procLabels)
+	c.ctxtSwitches = desc("context_switches_total", "Context switches, voluntary or nonvoluntary", ctxtLabels)
+	c.startTime = desc("start_time_seconds", "Start time of the process since unix epoch in seconds", procLabels)
+	c.uptime = desc("uptime_seconds", "How long the process has been running, or been seen if start time is unknown", procLabels)
+	c.netRecvBytes = desc("net_recv_bytes_total", "Received Bytes", listenLabels)
+	c.netRecvPackets = desc("net_recv_packets_total", "Received Packets", listenLabels)
+	c.netRecvPeerBytes = desc("net_recv_peer_bytes_total", "Received Bytes from top remote peers, only for configured ports", peerLabels)
+	c.netRecvPeerPackets = desc("net_recv_peer_packets_total", "Received Packets from top remote peers, only for configured ports", peerLabels)
+	c.netSendFromBytes = desc("net_sendfrom_bytes_total", "send bytes from local port", listenLabels)
+	c.netSendFromPackets = desc("net_sendfrom_packets_total", "send packets from local port", listenLabels)
+	c.netSendToBytes = desc("net_sendto_bytes_total", "send bytes to remote address", clientLabels)
+	c.netSendToPackets = desc("net_sendto_packets_total", "send packets to remote address", clientLabels)
+	c.ruleFailures = desc("traffic_rule_failures_total", "Count of traffic rules that failed to be created or deleted", nil)
+	c.starts = desc("process_starts_total", "Count of new processes, by group or by executable if not in any group", lifecycleLabels)
+	c.exits = desc("process_exits_total", "Count of exited processes, by group or by executable if not in any group", lifecycleLabels)
+	c.restarts = desc("process_restarts_total", "Count of processes started within the restart window after one exited", lifecycleLabels)
+	c.cgroupCPU = desc("cgroup_cpu_seconds_total", "CPU time consumed by all tasks in the cgroup", cgroupLabels)
+	c.cgroupMemory = desc("cgroup_memory_bytes", "Memory used by the cgroup, including page cache", cgroupLabels)
+	c.cgroupPIDs = desc("cgroup_pids", "Number of processes and threads in the cgroup", cgroupLabels)
+	c.cgroupReadBytes = desc("cgroup_io_read_bytes_total", "Bytes read from block devices by the cgroup", cgroupLabels)
+	c.cgroupWriteBytes = desc("cgroup_io_write_bytes_total", "Bytes written to block devices by the cgroup", cgroupLabels)
+	c.cgroupReads = desc("cgroup_io_reads_total", "Read operations on block devices by the cgroup", cgroupLabels)
+	c.cgroupWrites = desc("cgroup_io_writes_total", "Write operations on block devices by the cgroup", cgroupLabels)
+	c.cgroupSendBytes = desc("cgroup_net_send_bytes_total", "send bytes from all sockets in the cgroup", cgroupLabels)
+	c.cgroupSendPackets = desc("cgroup_net_send_packets_total", "send packets from all sockets in the cgroup", cgroupLabels)
+
+	c.group = newAggregateDescs(desc, "group", "the group", groupLabels)
+	c.tree = newAggregateDescs(desc, "tree", "the process and its descendants", treeLabels)
+}
+
+// SetMaxAge 修改两次采集的最小间隔
+func (c *Collector) SetMaxAge(maxAge time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxAge = maxAge
+}
+
+// SetRollup 设置是否导出每个进程连同子孙进程的汇总
+func (c *Collector) SetRollup(rollup bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rollup = rollup
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	descs := []*prometheus.Desc{
+		c.cpu, c.mem, c.rss, c.shared, c.data, c.swap, c.pss, c.uss,
+		c.ioReadChars, c.ioWriteChars, c.ioReadSyscalls, c.ioWriteSyscalls, c.ioReadBytes, c.ioWriteBytes,
+		c.openFDs, c.maxFDs, c.threads, c.ctxtSwitches, c.startTime, c.uptime,
+		c.netRecvBytes, c.netRecvPackets, c.netSendFromBytes, c.netSendFromPackets,
+		c.netRecvPeerBytes, c.netRecvPeerPackets, c.netSendToBytes, c.netSendToPackets,
+		c.ruleFailures, c.starts, c.exits, c.restarts,
+		c.cgroupCPU, c.cgroupMemory, c.cgroupPIDs,
+		c.cgroupReadBytes, c.cgroupWriteBytes, c.cgroupReads, c.cgroupWrites,
+		c.cgroupSendBytes, c.cgroupSendPackets,
+	}
+	descs = append(descs, c.group.all()...)
+	descs = append(descs, c.tree.all()...)
+
+	for _, d := range descs {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if c.lastSnap.IsZero() || now.Sub(c.lastSnap) >= c.maxAge {
+		c.refresh(now)
+	}
+
+	c.series.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(c.ruleFailures, prometheus.CounterValue, float64(c.monitor.TrafficRuleFailures()))
+}
+
+// refresh 采集一次并更新保存的序列。失败时保留上次的结果，下次抓取再试
+func (c *Collector) refresh(now time.Time) {
+	procs, err := c.monitor.Snap()
+	if err != nil {
+		log.Printf("Snap FAILED: %s\n", err)
+		return
+	}
+	c.lastSnap = now
+
+	c.series.Begin(now)
+	c.counters.Begin(now)
+	for _, p := range procs {
+		c.series.Add(c.cpu, prometheus.GaugeValue, float64(p.CPU), c.procValues(p)...)
+		c.series.Add(c.mem, prometheus.GaugeValue, float64(p.MemoryVirtual), c.procValues(p)...)
+		c.series.Add(c.rss, prometheus.GaugeValue, float64(p.RSS), c.procValues(p)...)
+		c.series.Add(c.shared, prometheus.GaugeValue, float64(p.Shared), c.procValues(p)...)
+		c.series.Add(c.data, prometheus.GaugeValue, float64(p.Data), c.procValues(p)...)
+		c.series.Add(c.swap, prometheus.GaugeValue, float64(p.Swap), c.procValues(p)...)
+		if p.Smaps {
+			c.series.Add(c.pss, prometheus.GaugeValue, float64(p.PSS), c.procValues(p)...)
+			c.series.Add(c.uss, prometheus.GaugeValue, float64(p.USS), c.procValues(p)...)
+		}
+		c.addResources(p)
+		c.series.Add(c.uptime, prometheus.GaugeValue, p.Uptime(now).Seconds(), c.procValues(p)...)
+
+		for _, l := range p.ListenPorts {
+			labels := append(c.procValues(p), strconv.Itoa(l.Port), string(l.Family), string(l.Protocol))
+			c.series.Add(c.netRecvBytes, prometheus.CounterValue, float64(l.InBytes), labels...)
+			c.series.Add(c.netRecvPackets, prometheus.CounterValue, float64(l.InPackets), labels...)
+			c.series.Add(c.netSendFromBytes, prometheus.CounterValue, float64(l.OutBytes), labels...)
+			c.series.Add(c.netSendFromPackets, prometheus.CounterValue, float64(l.OutPackets), labels...)
+
+			// 只有最多的几个远端地址，掉出去的过了grace就不导出了
+			for _, peer := range l.Peers {
+				peerLabels := append(append([]string{}, labels...), peer.Address)
+				c.series.Add(c.netRecvPeerBytes, prometheus.CounterValue, float64(peer.Bytes), peerLabels...)
+				c.series.Add(c.netRecvPeerPackets, prometheus.CounterValue, float64(peer.Packets), peerLabels...)
+			}
+		}
+
+		for _, cc := range p.ClientConns {
+			labels := append(c.procValues(p), cc.Address, strconv.Itoa(cc.Port), string(cc.Family), string(cc.Protocol))
+			c.series.Add(c.netSendToBytes, prometheus.CounterValue, float64(cc.Bytes), labels...)
+			c.series.Add(c.netSendToPackets, prometheus.CounterValue, float64(cc.Packets), labels...)
+		}
+	}
+	c.addAggregates(procs)
+	c.addLifecycle(c.monitor.Events())
+	c.addCgroups(c.monitor.Cgroups())
+	for _, t := range c.monitor.CgroupTraffic() {
+		labels := []string{t.Group, t.Path, t.ContainerID, t.Unit}
+		c.series.Add(c.cgroupSendBytes, prometheus.CounterValue, float64(t.Bytes), labels...)
+		c.series.Add(c.cgroupSendPackets, prometheus.CounterValue, float64(t.Packets), labels...)
+	}
+
+	// 进程退出、连接关闭以后的序列，过了grace就不再导出
+	if n := c.series.Sweep(); n > 0 {
+		log.Printf("removed %d stale series\n", n)
+	}
+}
+
+// 一种事件的计数
+type lifecycleKey struct {
+	typ     proc.EventType
+	group   string
+	command string
+}
+
+// addLifecycle 累加这次的事件，导出所有的计数。计数一直都导出，不会因为进程没了就消失。
+// 不属于组的进程事件里是可执行文件名，不是整个命令行，所以计数不会越来越多
+func (c *Collector) addLifecycle(events []proc.Event) {
+	for _, e := range events {
+		c.lifecycle[lifecycleKey{typ: e.Type, group: e.Group, command: e.Command}]++
+	}
+
+	descs := map[proc.EventType]*prometheus.Desc{
+		proc.EventStart:   c.starts,
+		proc.EventExit:    c.exits,
+		proc.EventRestart: c.restarts,
+	}
+	for k, n := range c.lifecycle {
+		c.series.Add(descs[k.typ], prometheus.CounterValue, float64(n), k.group, k.command)
+	}
+}
+
+// addCgroups 导出unit、容器的cgroup资源用量，io控制器没打开的不导出io
+func (c *Collector) addCgroups(cgroups []*proc.Cgroup) {
+	for _, cg := range cgroups {
+		labels := []string{cg.Group, cg.Path, cg.ContainerID, cg.Unit}
+		c.series.Add(c.cgroupCPU, prometheus.CounterValue, cg.CPU, labels...)
+		c.series.Add(c.cgroupMemory, prometheus.GaugeValue, float64(cg.Memory), labels...)
+		c.series.Add(c.cgroupPIDs, prometheus.GaugeValue, float64(cg.PIDs), labels...)
+
+		if cg.IO != nil {
+			c.series.Add(c.cgroupReadBytes, prometheus.CounterValue, float64(cg.IO.ReadBytes), labels...)
+			c.series.Add(c.cgroupWriteBytes, prometheus.CounterValue, float64(cg.IO.WriteBytes), labels...)
+			c.series.Add(c.cgroupReads, prometheus.CounterValue, float64(cg.IO.Reads), labels...)
+			c.series.Add(c.cgroupWrites, prometheus.CounterValue, float64(cg.IO.Writes), labels...)
+		}
+	}
+}
+
+// addResources 导出io、文件数、线程这些，取不到的不导出
+func (c *Collector) addResources(p *proc.Proc) {
+	if p.IO != nil {
+		c.series.Add(c.ioReadChars, prometheus.CounterValue, float64(p.IO.ReadChars), c.procValues(p)...)
+		c.series.Add(c.ioWriteChars, prometheus.CounterValue, float64(p.IO.WriteChars), c.procValues(p)...)
+		c.series.Add(c.ioReadSyscalls, prometheus.CounterValue, float64(p.IO.ReadSyscalls), c.procValues(p)...)
+		c.series.Add(c.ioWriteSyscalls, prometheus.CounterValue, float64(p.IO.WriteSyscalls), c.procValues(p)...)
+		c.series.Add(c.ioReadBytes, prometheus.CounterValue, float64(p.IO.ReadBytes), c.procValues(p)...)
+		c.series.Add(c.ioWriteBytes, prometheus.CounterValue, float64(p.IO.WriteBytes), c.procValues(p)...)
+	}
+
+	if p.FDs != nil {
+		c.series.Add(c.openFDs, prometheus.GaugeValue, float64(p.FDs.Open), c.procValues(p)...)
+		// 没有限制的话不导出，免得算比例时除以0
+		if p.FDs.Limit > 0 {
+			c.series.Add(c.maxFDs, prometheus.GaugeValue, float64(p.FDs.Limit), c.procValues(p)...)
+		}
+	}
+
+	// 线程数和上下文切换一起从status读，ps取不到
+	if p.Threads > 0 {
+		c.series.Add(c.threads, prometheus.GaugeValue, float64(p.Threads), c.procValues(p)...)
+		c.series.Add(c.ctxtSwitches, prometheus.CounterValue, float64(p.VoluntaryCtxtSwitches), append(c.procValues(p), "voluntary")...)
+		c.series.Add(c.ctxtSwitches, prometheus.CounterValue, float64(p.NonvoluntaryCtxtSwitches), append(c.procValues(p), "nonvoluntary")...)
+	}
+
+	if !p.StartedAt.IsZero() {
+		c.series.Add(c.startTime, prometheus.GaugeValue, float64(p.StartedAt.Unix()), c.procValues(p)...)
+	}
+}
+
+// addAggregates 把属于同一个组、同一棵进程树的进程汇总起来。cpu、内存是这次的总和，流量是累计的
+func (c *Collector) addAggregates(procs []*proc.Proc) {
+	gauges := make(map[groupKey]float64)
+
+	for _, p := range procs {
+		if p.Group != "" {
+			c.addAggregate(gauges, &c.group, []string{p.Group}, p)
+		}
+	}
+
+	if c.rollup {
+		for _, p := range procs {
+			// 只是因为祖先匹配才记录的进程已经算在祖先里了
+			if p.Descendant {
+				continue
+			}
+
+			labels := c.procValues(p)
+			walkTree(p, func(q *proc.Proc) {
+				c.addAggregate(gauges, &c.tree, labels, q)
+			})
+		}
+	}
+
+	for k, v := range gauges {
+		c.series.Add(k.desc, prometheus.GaugeValue, v, k.labelValues()...)
+	}
+
+	c.counters.Sweep()
+	c.counters.Each(func(desc *prometheus.Desc, labels []string, value float64) {
+		c.series.Add(desc, prometheus.CounterValue, value, labels...)
+	})
+}
+
+// addAggregate 把一个进程加到labels表示的汇总里
+func (c *Collector) addAggregate(gauges map[groupKey]float64, d *aggregateDescs, labels []string, p *proc.Proc) {
+	gauges[newGroupKey(d.procs, labels...)]++
+	gauges[newGroupKey(d.cpu, labels...)] += float64(p.CPU)
+	gauges[newGroupKey(d.mem, labels...)] += float64(p.MemoryVirtual)
+	gauges[newGroupKey(d.rss, labels...)] += float64(p.RSS)
+
+	// 带上启动时间，pid被复用时算成另一个成员
+	pid := strconv.Itoa(p.PID)
+	startTime := strconv.FormatUint(p.StartTime, 10)
+	for _, l := range p.ListenPorts {
+		member := []string{pid, startTime, strconv.Itoa(l.Port), string(l.Family), string(l.Protocol)}
+		c.counters.Add(d.netRecvBytes, labels, float64(l.InBytes), member...)
+		c.counters.Add(d.netRecvPackets, labels, float64(l.InPackets), member...)
+		c.counters.Add(d.netSendFromBytes, labels, float64(l.OutBytes), member...)
+		c.counters.Add(d.netSendFromPackets, labels, float64(l.OutPackets), member...)
+	}
+
+	for _, cc := range p.ClientConns {
+		member := []string{pid, startTime, cc.Address, strconv.Itoa(cc.Port), string(cc.Family), string(cc.Protocol)}
+		c.counters.Add(d.netSendToBytes, labels, float64(cc.Bytes), member...)
+		c.counters.Add(d.netSendToPackets, labels, float64(cc.Packets), member...)
+	}
+}
+
+// walkTree 依次处理进程自己和它所有记录了的子孙进程
+func walkTree(p *proc.Proc, f func(*proc.Proc)) {
+	f(p)
+	for _, child := range p.Children {
+		walkTree(child, f)
+	}
+}
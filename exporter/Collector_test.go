@@ -0,0 +1,356 @@
+package exporter
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/wanghengwei/monclient/net"
+	"github.com/wanghengwei/monclient/proc"
+)
+
+// fakeMonitor 依次返回snaps和events里的结果
+type fakeMonitor struct {
+	snaps   [][]*proc.Proc
+	events  [][]proc.Event
+	cgroups [][]*proc.Cgroup
+	traffic [][]*proc.CgroupTraffic
+	calls   int
+}
+
+func (m *fakeMonitor) Snap() ([]*proc.Proc, error) {
+	procs := m.snaps[m.calls]
+	m.calls++
+	return procs, nil
+}
+
+func (m *fakeMonitor) Events() []proc.Event {
+	if m.calls-1 < len(m.events) {
+		return m.events[m.calls-1]
+	}
+	return nil
+}
+
+func (m *fakeMonitor) Cgroups() []*proc.Cgroup {
+	if m.calls-1 < len(m.cgroups) {
+		return m.cgroups[m.calls-1]
+	}
+	return nil
+}
+
+func (m *fakeMonitor) CgroupTraffic() []*proc.CgroupTraffic {
+	if m.calls-1 < len(m.traffic) {
+		return m.traffic[m.calls-1]
+	}
+	return nil
+}
+
+func (m *fakeMonitor) TrafficRuleFailures() uint64 {
+	return 2
+}
+
+func newTestCollector(m Monitor) (*Collector, *time.Time) {
+	now := time.Unix(1000, 0)
+	c := NewCollector(m, 10*time.Second, 30*time.Second)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestCollector(t *testing.T) {
+	p := &proc.Proc{PID: 1234, Command: "service_box", CPU: 12.5, MemoryVirtual: 1024, RSS: 512, Swap: 64}
+	p.AddListenPort(net.IPv4, net.TCP, 8080)
+	p.ListenPorts[0].InBytes = 1000
+	p.ListenPorts[0].InPackets = 10
+
+	// 没读smaps的不导出pss
+	other := &proc.Proc{PID: 1, Command: "init", Smaps: false}
+	p.Smaps, p.PSS = true, 256
+
+	c, _ := newTestCollector(&fakeMonitor{snaps: [][]*proc.Proc{{p, other}}})
+
+	expected := `
+# HELP x51_cpu_usage CPU Usage
+# TYPE x51_cpu_usage gauge
+x51_cpu_usage{cmd="init",group="",pid="1"} 0
+x51_cpu_usage{cmd="service_box",group="",pid="1234"} 12.5
+# HELP x51_mem_pss Proportional Set Size, only for groups reading smaps
+# TYPE x51_mem_pss gauge
+x51_mem_pss{cmd="service_box",group="",pid="1234"} 256
+# HELP x51_mem_swap Swapped out Memory
+# TYPE x51_mem_swap gauge
+x51_mem_swap{cmd="init",group="",pid="1"} 0
+x51_mem_swap{cmd="service_box",group="",pid="1234"} 64
+# HELP x51_net_recv_bytes_total Received Bytes
+# TYPE x51_net_recv_bytes_total counter
+x51_net_recv_bytes_total{cmd="service_box",family="ipv4",group="",pid="1234",port="8080",protocol="tcp"} 1000
+# HELP x51_traffic_rule_failures_total Count of traffic rules that failed to be created or deleted
+# TYPE x51_traffic_rule_failures_total counter
+x51_traffic_rule_failures_total 2
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected), "x51_cpu_usage", "x51_mem_pss", "x51_mem_swap", "x51_net_recv_bytes_total", "x51_traffic_rule_failures_total")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectorMaxAge(t *testing.T) {
+	m := &fakeMonitor{snaps: [][]*proc.Proc{
+		{{PID: 1, Command: "a"}},
+		{{PID: 2, Command: "b"}},
+	}}
+	c, now := newTestCollector(m)
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	for i := 0; i < 3; i++ {
+		if _, err := reg.Gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.calls != 1 {
+		t.Errorf("snapped %d times", m.calls)
+	}
+
+	*now = now.Add(10 * time.Second)
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if m.calls != 2 {
+		t.Errorf("snapped %d times", m.calls)
+	}
+}
+
+func TestCollectorStale(t *testing.T) {
+	a := &proc.Proc{PID: 1, Command: "a"}
+	b := &proc.Proc{PID: 2, Command: "b"}
+	m := &fakeMonitor{snaps: [][]*proc.Proc{{a, b}, {a}, {a}}}
+	c, now := newTestCollector(m)
+
+	// 第一次两个进程，每个进程7个指标，再加上规则失败数
+	if n := testutil.CollectAndCount(c); n != 15 {
+		t.Error(n)
+	}
+
+	// b 退出了，grace以内还在
+	*now = now.Add(20 * time.Second)
+	if n := testutil.CollectAndCount(c); n != 15 {
+		t.Error(n)
+	}
+
+	*now = now.Add(20 * time.Second)
+	if n := testutil.CollectAndCount(c); n != 8 {
+		t.Error(n)
+	}
+}
+
+func TestCollectorGroups(t *testing.T) {
+	newProc := func(pid int, startTime uint64, in uint64) *proc.Proc {
+		p := &proc.Proc{PID: pid, StartTime: startTime, Command: "service_box", Group: "logic", CPU: 10, RSS: 100}
+		p.AddListenPort(net.IPv4, net.TCP, 8080+pid)
+		p.ListenPorts[0].InBytes = in
+		return p
+	}
+
+	m := &fakeMonitor{snaps: [][]*proc.Proc{
+		{newProc(1, 1, 100), newProc(2, 1, 50), {PID: 3, Command: "nginx", CPU: 5}},
+		// 2 退出了，1 的规则被重建计数从头开始
+		{newProc(1, 1, 30)},
+		// pid 1 被复用了
+		{newProc(1, 2, 20)},
+	}}
+	c, now := newTestCollector(m)
+
+	for _, want := range [][3]float64{{20, 150, 2}, {10, 180, 1}, {10, 200, 1}} {
+		expected := fmt.Sprintf(`
+# HELP x51_group_cpu_usage CPU Usage of the group
+# TYPE x51_group_cpu_usage gauge
+x51_group_cpu_usage{group="logic"} %v
+# HELP x51_group_net_recv_bytes_total Received Bytes of the group
+# TYPE x51_group_net_recv_bytes_total counter
+x51_group_net_recv_bytes_total{group="logic"} %v
+# HELP x51_group_processes Number of processes in the group
+# TYPE x51_group_processes gauge
+x51_group_processes{group="logic"} %v
+`, want[0], want[1], want[2])
+		err := testutil.CollectAndCompare(c, strings.NewReader(expected), "x51_group_cpu_usage", "x51_group_net_recv_bytes_total", "x51_group_processes")
+		if err != nil {
+			t.Error(err)
+		}
+		*now = now.Add(10 * time.Second)
+	}
+}
+
+func TestCollectorRollup(t *testing.T) {
+	parent := &proc.Proc{PID: 1234, Command: "service_box", CPU: 10, RSS: 100}
+	parent.AddListenPort(net.IPv4, net.TCP, 8080)
+	parent.ListenPorts[0].InBytes = 100
+	worker := &proc.Proc{PID: 1240, PPID: 1234, Command: "worker", CPU: 5, RSS: 50, Descendant: true}
+	worker.AddListenPort(net.IPv4, net.TCP, 9090)
+	worker.ListenPorts[0].InBytes = 20
+	parent.Children = []*proc.Proc{worker}
+
+	c, _ := newTestCollector(&fakeMonitor{snaps: [][]*proc.Proc{{parent, worker}}})
+	c.SetRollup(true)
+
+	// worker 只算在service_box的树里，自己没有
+	expected := `
+# HELP x51_tree_cpu_usage CPU Usage of the process and its descendants
+# TYPE x51_tree_cpu_usage gauge
+x51_tree_cpu_usage{cmd="service_box",group="",pid="1234"} 15
+# HELP x51_tree_net_recv_bytes_total Received Bytes of the process and its descendants
+# TYPE x51_tree_net_recv_bytes_total counter
+x51_tree_net_recv_bytes_total{cmd="service_box",group="",pid="1234"} 120
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected), "x51_tree_cpu_usage", "x51_tree_net_recv_bytes_total")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectorResources(t *testing.T) {
+	p := &proc.Proc{
+		PID:                   1234,
+		Command:               "service_box",
+		IO:                    &proc.IOStats{ReadBytes: 4096},
+		FDs:                   &proc.FDStats{Open: 900, Limit: 1024},
+		Threads:               8,
+		VoluntaryCtxtSwitches: 5000,
+		StartedAt:             time.Unix(1600000050, 0),
+	}
+	// ps取不到这些，都不导出
+	other := &proc.Proc{PID: 1, Command: "init"}
+
+	c, _ := newTestCollector(&fakeMonitor{snaps: [][]*proc.Proc{{p, other}}})
+
+	expected := `
+# HELP x51_context_switches_total Context switches, voluntary or nonvoluntary
+# TYPE x51_context_switches_total counter
+x51_context_switches_total{cmd="service_box",group="",pid="1234",type="nonvoluntary"} 0
+x51_context_switches_total{cmd="service_box",group="",pid="1234",type="voluntary"} 5000
+# HELP x51_io_read_bytes_total Bytes read from storage
+# TYPE x51_io_read_bytes_total counter
+x51_io_read_bytes_total{cmd="service_box",group="",pid="1234"} 4096
+# HELP x51_max_fds Soft limit of open file descriptors
+# TYPE x51_max_fds gauge
+x51_max_fds{cmd="service_box",group="",pid="1234"} 1024
+# HELP x51_open_fds Number of open file descriptors
+# TYPE x51_open_fds gauge
+x51_open_fds{cmd="service_box",group="",pid="1234"} 900
+# HELP x51_start_time_seconds Start time of the process since unix epoch in seconds
+# TYPE x51_start_time_seconds gauge
+x51_start_time_seconds{cmd="service_box",group="",pid="1234"} 1.60000005e+09
+# HELP x51_threads Number of threads
+# TYPE x51_threads gauge
+x51_threads{cmd="service_box",group="",pid="1234"} 8
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"x51_context_switches_total", "x51_io_read_bytes_total", "x51_max_fds", "x51_open_fds", "x51_start_time_seconds", "x51_threads")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectorCgroupLabels(t *testing.T) {
+	p := &proc.Proc{PID: 1234, Command: "service_box", CPU: 12.5, ContainerID: "3f2a9c", Unit: "docker-3f2a9c.scope"}
+	other := &proc.Proc{PID: 1, Command: "init", Unit: "init.scope"}
+
+	c, _ := newTestCollector(&fakeMonitor{snaps: [][]*proc.Proc{{p, other}}})
+	c.EnableCgroupLabels()
+
+	expected := `
+# HELP x51_cpu_usage CPU Usage
+# TYPE x51_cpu_usage gauge
+x51_cpu_usage{cmd="init",container="",group="",pid="1",unit="init.scope"} 0
+x51_cpu_usage{cmd="service_box",container="3f2a9c",group="",pid="1234",unit="docker-3f2a9c.scope"} 12.5
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected), "x51_cpu_usage")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectorCgroups(t *testing.T) {
+	logic := &proc.Cgroup{Path: "/system.slice/game-logic.service", Group: "logic", Unit: "game-logic.service", CPU: 2.5, Memory: 4096, PIDs: 12,
+		IO: &proc.CgroupIO{ReadBytes: 5120, Writes: 2}}
+	// io控制器没打开
+	box := &proc.Cgroup{Path: "/docker/3f2a9c", ContainerID: "3f2a9c", CPU: 1, Memory: 2048, PIDs: 1}
+
+	traffic := &proc.CgroupTraffic{Path: "/system.slice/game-logic.service", Group: "logic", Unit: "game-logic.service", Bytes: 700, Packets: 7}
+
+	c, _ := newTestCollector(&fakeMonitor{snaps: [][]*proc.Proc{{}}, cgroups: [][]*proc.Cgroup{{logic, box}}, traffic: [][]*proc.CgroupTraffic{{traffic}}})
+
+	expected := `
+# HELP x51_cgroup_cpu_seconds_total CPU time consumed by all tasks in the cgroup
+# TYPE x51_cgroup_cpu_seconds_total counter
+x51_cgroup_cpu_seconds_total{cgroup="/docker/3f2a9c",container="3f2a9c",group="",unit=""} 1
+x51_cgroup_cpu_seconds_total{cgroup="/system.slice/game-logic.service",container="",group="logic",unit="game-logic.service"} 2.5
+# HELP x51_cgroup_io_read_bytes_total Bytes read from block devices by the cgroup
+# TYPE x51_cgroup_io_read_bytes_total counter
+x51_cgroup_io_read_bytes_total{cgroup="/system.slice/game-logic.service",container="",group="logic",unit="game-logic.service"} 5120
+# HELP x51_cgroup_net_send_bytes_total send bytes from all sockets in the cgroup
+# TYPE x51_cgroup_net_send_bytes_total counter
+x51_cgroup_net_send_bytes_total{cgroup="/system.slice/game-logic.service",container="",group="logic",unit="game-logic.service"} 700
+# HELP x51_cgroup_pids Number of processes and threads in the cgroup
+# TYPE x51_cgroup_pids gauge
+x51_cgroup_pids{cgroup="/docker/3f2a9c",container="3f2a9c",group="",unit=""} 1
+x51_cgroup_pids{cgroup="/system.slice/game-logic.service",container="",group="logic",unit="game-logic.service"} 12
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected), "x51_cgroup_cpu_seconds_total", "x51_cgroup_io_read_bytes_total", "x51_cgroup_net_send_bytes_total", "x51_cgroup_pids")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectorPeers(t *testing.T) {
+	p := &proc.Proc{PID: 1234, Command: "gateway"}
+	p.AddListenPort(net.IPv4, net.TCP, 8080)
+	p.ListenPorts[0].Peers = []*proc.PeerTraffic{{Address: "10.0.0.2", Bytes: 300, Packets: 3}, {Address: "10.0.0.1", Bytes: 100, Packets: 1}}
+	p.AddListenPort(net.IPv4, net.TCP, 22)
+
+	c, _ := newTestCollector(&fakeMonitor{snaps: [][]*proc.Proc{{p}}})
+
+	expected := `
+# HELP x51_net_recv_peer_bytes_total Received Bytes from top remote peers, only for configured ports
+# TYPE x51_net_recv_peer_bytes_total counter
+x51_net_recv_peer_bytes_total{cmd="gateway",family="ipv4",group="",peer="10.0.0.1",pid="1234",port="8080",protocol="tcp"} 100
+x51_net_recv_peer_bytes_total{cmd="gateway",family="ipv4",group="",peer="10.0.0.2",pid="1234",port="8080",protocol="tcp"} 300
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected), "x51_net_recv_peer_bytes_total")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectorLifecycle(t *testing.T) {
+	p := &proc.Proc{PID: 101, Command: "service_box", Group: "logic", FirstSeen: time.Unix(990, 0)}
+	m := &fakeMonitor{
+		snaps: [][]*proc.Proc{{p}, {p}},
+		events: [][]proc.Event{
+			{{Type: proc.EventExit, Group: "logic"}, {Type: proc.EventRestart, Group: "logic", Proc: p}},
+			{{Type: proc.EventStart, Command: "nginx"}, {Type: proc.EventStart, Command: "nginx"}, {Type: proc.EventRestart, Group: "logic", Proc: p}},
+		},
+	}
+	c, now := newTestCollector(m)
+	testutil.CollectAndCount(c)
+	*now = now.Add(10 * time.Second)
+
+	expected := `
+# HELP x51_process_restarts_total Count of processes started within the restart window after one exited
+# TYPE x51_process_restarts_total counter
+x51_process_restarts_total{cmd="",group="logic"} 2
+# HELP x51_process_starts_total Count of new processes, by group or by executable if not in any group
+# TYPE x51_process_starts_total counter
+x51_process_starts_total{cmd="nginx",group=""} 2
+# HELP x51_uptime_seconds How long the process has been running, or been seen if start time is unknown
+# TYPE x51_uptime_seconds gauge
+x51_uptime_seconds{cmd="service_box",group="logic",pid="101"} 20
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected), "x51_process_restarts_total", "x51_process_starts_total", "x51_uptime_seconds")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,100 @@
+package exporter
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 组的一个指标。labels 是组的标签值，用\x00连起来，这样可以当map的key
+type groupKey struct {
+	desc   *prometheus.Desc
+	labels string
+}
+
+func newGroupKey(desc *prometheus.Desc, labels ...string) groupKey {
+	return groupKey{desc: desc, labels: strings.Join(labels, "\x00")}
+}
+
+func (k groupKey) labelValues() []string {
+	return strings.Split(k.labels, "\x00")
+}
+
+type groupMember struct {
+	group    groupKey
+	value    float64
+	lastSeen time.Time
+}
+
+// groupCounters 把组里每个成员（进程的端口、连接）的计数累加成组的计数。组可以是配置里的进程组，也可以是一棵进程树。
+// 每次只加成员的增量，成员消失以后它贡献的部分还在，所以组的计数只增不减，
+// 不会因为进程重启、退出变小
+type groupCounters struct {
+	grace time.Duration
+	cycle time.Time
+
+	totals map[groupKey]float64
+	// 成员上一次的值。消失不到grace的成员还留着，免得一次没采到再出现时又加一遍
+	members map[string]*groupMember
+	// 每个组还有几个成员，没有了就不再导出这个组
+	counts map[groupKey]int
+}
+
+func newGroupCounters(grace time.Duration) *groupCounters {
+	return &groupCounters{
+		grace:   grace,
+		totals:  make(map[groupKey]float64),
+		members: make(map[string]*groupMember),
+		counts:  make(map[groupKey]int),
+	}
+}
+
+// Begin 开始新的一轮
+func (g *groupCounters) Begin(now time.Time) {
+	g.cycle = now
+}
+
+// Add 记录一个成员本轮的值。值变小说明计数被清零过，这时整个值都是增量
+func (g *groupCounters) Add(desc *prometheus.Desc, labels []string, value float64, member ...string) {
+	gk := newGroupKey(desc, labels...)
+	key := desc.String() + "\x00" + gk.labels + "\x00" + strings.Join(member, "\x00")
+
+	m, ok := g.members[key]
+	if !ok {
+		m = &groupMember{group: gk}
+		g.members[key] = m
+		g.counts[gk]++
+	}
+
+	if value >= m.value {
+		g.totals[gk] += value - m.value
+	} else {
+		g.totals[gk] += value
+	}
+	m.value = value
+	m.lastSeen = g.cycle
+}
+
+// Sweep 删除超过grace没出现的成员，组里一个成员都没有了就把组也删掉
+func (g *groupCounters) Sweep() {
+	for key, m := range g.members {
+		if g.cycle.Sub(m.lastSeen) <= g.grace {
+			continue
+		}
+
+		delete(g.members, key)
+		g.counts[m.group]--
+		if g.counts[m.group] == 0 {
+			delete(g.counts, m.group)
+			delete(g.totals, m.group)
+		}
+	}
+}
+
+// Each 遍历所有组的累计值
+func (g *groupCounters) Each(f func(desc *prometheus.Desc, labels []string, value float64)) {
+	for gk, v := range g.totals {
+		f(gk.desc, gk.labelValues(), v)
+	}
+}
@@ -0,0 +1,64 @@
+package exporter
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type seriesEntry struct {
+	metric   prometheus.Metric
+	lastSeen time.Time
+}
+
+// seriesStore 保存每个序列最近一次的值。
+// 进程退出、连接关闭以后序列就不会再出现了，超过grace以后删掉，
+// 在这之前还是导出最后的值，免得一次没采到就断掉
+type seriesStore struct {
+	grace time.Duration
+	// 本轮开始的时间
+	cycle  time.Time
+	series map[string]*seriesEntry
+}
+
+func newSeriesStore(grace time.Duration) *seriesStore {
+	return &seriesStore{
+		grace:  grace,
+		series: make(map[string]*seriesEntry),
+	}
+}
+
+// Begin 开始新的一轮
+func (s *seriesStore) Begin(now time.Time) {
+	s.cycle = now
+}
+
+// Add 记录本轮的一个值
+func (s *seriesStore) Add(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labels ...string) {
+	key := desc.String() + "\x00" + strings.Join(labels, "\x00")
+	s.series[key] = &seriesEntry{
+		metric:   prometheus.MustNewConstMetric(desc, valueType, value, labels...),
+		lastSeen: s.cycle,
+	}
+}
+
+// Sweep 删除超过grace没有出现的序列，返回删了多少个
+func (s *seriesStore) Sweep() int {
+	n := 0
+	for key, e := range s.series {
+		if s.cycle.Sub(e.lastSeen) > s.grace {
+			delete(s.series, key)
+			n++
+		}
+	}
+
+	return n
+}
+
+// Collect 输出所有保存的序列
+func (s *seriesStore) Collect(ch chan<- prometheus.Metric) {
+	for _, e := range s.series {
+		ch <- e.metric
+	}
+}
@@ -3,8 +3,10 @@ package lsof
 import (
 	"fmt"
 	"log"
+	"net"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/wanghengwei/monclient/cmdutil"
 )
@@ -19,12 +21,26 @@ const (
 	Established
 )
 
+// 地址族，和lsof输出的TYPE列一致
+const (
+	IPv4 = "IPv4"
+	IPv6 = "IPv6"
+)
+
+// 协议，和lsof输出的NODE列一致
+const (
+	TCP = "TCP"
+	UDP = "UDP"
+)
+
 type SocketType int
 
 type Lsof struct{}
 
 func (l *Lsof) Run() (*Result, error) {
-	cmd := cmdutil.NewCommand("lsof", "-a", "-n", "-P", "-i4TCP")
+	cmd := cmdutil.NewCommand("lsof", "-n", "-P", "-iTCP", "-iUDP")
+	// 没有tcp或者没有udp的socket时lsof返回1，另一种协议的结果还是要的
+	cmd.NoMatchExitCode = true
 	lines, err := cmd.Run()
 	if err != nil {
 		return nil, err
@@ -42,8 +58,31 @@ func (l *Lsof) Run() (*Result, error) {
 
 		n := len(line.Fields)
 
-		connType := line.GetField(n - 1).String()
-		nameField := line.GetField(n - 2).String()
+		family := line.GetField(4).String()
+		if family != IPv4 && family != IPv6 {
+			log.Printf("skip line with unknown type: %s\n", line)
+			continue
+		}
+
+		protocol := line.GetField(7).String()
+
+		var connType, nameField string
+		switch protocol {
+		case TCP:
+			connType = line.GetField(n - 1).String()
+			nameField = line.GetField(n - 2).String()
+		case UDP:
+			// udp没有状态这一列。没有对端地址的就是绑定了端口收包的，当成监听处理
+			nameField = line.GetField(n - 1).String()
+			if strings.Contains(nameField, "->") {
+				connType = "(ESTABLISHED)"
+			} else {
+				connType = "(LISTEN)"
+			}
+		default:
+			log.Printf("skip line with unknown protocol: %s\n", line)
+			continue
+		}
 
 		var item Item
 
@@ -56,10 +95,11 @@ func (l *Lsof) Run() (*Result, error) {
 			}
 
 			port, _ := strconv.Atoi(ms[2])
+			addr, _ := normalizeAddress(ms[1])
 
 			item = &ListenItem{
-				BaseItem:    BaseItem{pid},
-				BindAddress: ms[1],
+				BaseItem:    BaseItem{PID: pid, Family: family, Protocol: protocol},
+				BindAddress: addr,
 				BindPort:    port,
 			}
 
@@ -73,12 +113,18 @@ func (l *Lsof) Run() (*Result, error) {
 
 			sport, _ := strconv.Atoi(ms[2])
 			dport, _ := strconv.Atoi(ms[4])
+			saddr, _ := normalizeAddress(ms[1])
+			daddr, mapped := normalizeAddress(ms[3])
+			// 双栈socket上的ipv4连接，当成ipv4处理
+			if mapped {
+				family = IPv4
+			}
 
 			item = &EstablishedItem{
-				BaseItem:      BaseItem{pid},
-				SourceAddress: ms[1],
+				BaseItem:      BaseItem{PID: pid, Family: family, Protocol: protocol},
+				SourceAddress: saddr,
 				SourcePort:    sport,
-				TargetAddress: ms[3],
+				TargetAddress: daddr,
 				TargetPort:    dport,
 			}
 
@@ -93,6 +139,19 @@ func (l *Lsof) Run() (*Result, error) {
 	return rez, nil
 }
 
+// normalizeAddress 去掉ipv6地址两边的方括号，如果是 ::ffff:1.2.3.4 这种映射的ipv4地址，
+// 转成ipv4地址并返回true
+func normalizeAddress(addr string) (string, bool) {
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() == nil || strings.Index(addr, ":") < 0 {
+		return addr, false
+	}
+
+	return ip.To4().String(), true
+}
+
 type Result struct {
 	items []Item
 }
@@ -125,6 +184,10 @@ type Item interface{}
 
 type BaseItem struct {
 	PID int
+	// IPv4 或 IPv6
+	Family string
+	// TCP 或 UDP
+	Protocol string
 }
 
 type ListenItem struct {
@@ -8,7 +8,7 @@ func TestRun(t *testing.T) {
 	lsof := &Lsof{}
 	r, err := lsof.Run()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
 	t.Logf("found %d items\n", len(r.items))
@@ -16,3 +16,24 @@ func TestRun(t *testing.T) {
 		t.Logf("%v\n", item)
 	}
 }
+
+func TestNormalizeAddress(t *testing.T) {
+	cases := []struct {
+		in     string
+		out    string
+		mapped bool
+	}{
+		{"10.0.0.1", "10.0.0.1", false},
+		{"*", "*", false},
+		{"[::1]", "::1", false},
+		{"[2001:db8::1]", "2001:db8::1", false},
+		{"[::ffff:10.0.0.7]", "10.0.0.7", true},
+	}
+
+	for _, c := range cases {
+		out, mapped := normalizeAddress(c.in)
+		if out != c.out || mapped != c.mapped {
+			t.Errorf("%s: got %s %v", c.in, out, mapped)
+		}
+	}
+}
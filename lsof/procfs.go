@@ -0,0 +1,257 @@
+package lsof
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// /proc/net/tcp 里的连接状态，见内核的 include/net/tcp_states.h
+// udp也用这些值：connect过的是 ESTABLISHED，只bind了的是 CLOSE
+const (
+	tcpEstablished = "01"
+	tcpClose       = "07"
+	tcpListen      = "0A"
+)
+
+// /proc/net 下要读的文件
+var procNetFiles = []struct {
+	name     string
+	protocol string
+	v6       bool
+}{
+	{"tcp", TCP, false},
+	{"tcp6", TCP, true},
+	{"udp", UDP, false},
+	{"udp6", UDP, true},
+}
+
+// Provider 提供当前所有的socket信息。Lsof 和 Procfs 都实现了这个接口
+type Provider interface {
+	Run() (*Result, error)
+}
+
+// NewProvider 根据名字创建Provider。支持 lsof 和 procfs
+func NewProvider(name string) (Provider, error) {
+	switch name {
+	case "lsof":
+		return &Lsof{}, nil
+	case "procfs":
+		return NewProcfs("/proc"), nil
+	default:
+		return nil, fmt.Errorf("unknown socket provider: %s", name)
+	}
+}
+
+// Procfs 通过读取 /proc/net/{tcp,udp} 和 /proc/<pid>/fd 来得到和lsof一样的结果
+type Procfs struct {
+	root string
+}
+
+// NewProcfs 创建一个Procfs。root 一般是 /proc，测试时可以指向一个假的目录
+func NewProcfs(root string) *Procfs {
+	return &Procfs{root: root}
+}
+
+// 从 /proc/net/tcp 里解析出来的一行
+type procSocket struct {
+	family     string
+	protocol   string
+	listen     bool
+	localAddr  string
+	localPort  int
+	remoteAddr string
+	remotePort int
+}
+
+// Run 先读出所有tcp/udp socket，再通过fd找到每个socket属于哪个进程
+func (p *Procfs) Run() (*Result, error) {
+	sockets := make(map[string]*procSocket)
+	for _, f := range procNetFiles {
+		err := p.readSockets(filepath.Join(p.root, "net", f.name), f.protocol, f.v6, sockets)
+		if err != nil {
+			// 没有开ipv6的机器上不存在tcp6/udp6
+			if f.v6 && os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(p.root)
+	if err != nil {
+		return nil, err
+	}
+
+	rez := &Result{}
+
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid <= 0 {
+			continue
+		}
+
+		// 进程可能已经退出了，或者没有权限，都跳过
+		inodes, err := p.socketInodes(pid)
+		if err != nil {
+			continue
+		}
+
+		for _, inode := range inodes {
+			s, ok := sockets[inode]
+			if !ok {
+				continue
+			}
+
+			if s.listen {
+				rez.items = append(rez.items, &ListenItem{
+					BaseItem:    BaseItem{PID: pid, Family: s.family, Protocol: s.protocol},
+					BindAddress: s.localAddr,
+					BindPort:    s.localPort,
+				})
+			} else {
+				rez.items = append(rez.items, &EstablishedItem{
+					BaseItem:      BaseItem{PID: pid, Family: s.family, Protocol: s.protocol},
+					SourceAddress: s.localAddr,
+					SourcePort:    s.localPort,
+					TargetAddress: s.remoteAddr,
+					TargetPort:    s.remotePort,
+				})
+			}
+		}
+	}
+
+	return rez, nil
+}
+
+// readSockets 解析 /proc/net/tcp、udp 或对应的v6文件，结果按inode放进sockets
+// 每行大概长这样
+// 0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000 1000 0 12345 1 ...
+func (p *Procfs) readSockets(path string, protocol string, v6 bool, sockets map[string]*procSocket) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// 跳过表头
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		var listen bool
+		switch state := fields[3]; {
+		case state == tcpEstablished:
+			listen = false
+		case protocol == TCP && state == tcpListen, protocol == UDP && state == tcpClose:
+			listen = true
+		default:
+			continue
+		}
+
+		laddr, lport, err := parseHexAddress(fields[1])
+		if err != nil {
+			log.Printf("bad local address in %s: %s\n", path, err)
+			continue
+		}
+		raddr, rport, err := parseHexAddress(fields[2])
+		if err != nil {
+			log.Printf("bad remote address in %s: %s\n", path, err)
+			continue
+		}
+
+		// tcp6里也会有双栈socket上的ipv4连接，地址是 ::ffff:1.2.3.4 这种形式，当成ipv4处理
+		family := IPv4
+		if v6 && (laddr.To4() == nil || laddr.IsUnspecified()) {
+			family = IPv6
+		}
+
+		// 没有绑定端口的udp socket没什么好统计的
+		if listen && lport == 0 {
+			continue
+		}
+
+		sockets[fields[9]] = &procSocket{
+			family:     family,
+			protocol:   protocol,
+			listen:     listen,
+			localAddr:  formatAddress(laddr),
+			localPort:  lport,
+			remoteAddr: formatAddress(raddr),
+			remotePort: rport,
+		}
+	}
+
+	return scanner.Err()
+}
+
+// socketInodes 列出一个进程打开的所有socket的inode
+func (p *Procfs) socketInodes(pid int) ([]string, error) {
+	dir := filepath.Join(p.root, strconv.Itoa(pid), "fd")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rez := []string{}
+	for _, e := range entries {
+		link, err := os.Readlink(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+
+		// 形如 socket:[12345]
+		if strings.HasPrefix(link, "socket:[") && strings.HasSuffix(link, "]") {
+			rez = append(rez, link[len("socket:["):len(link)-1])
+		}
+	}
+
+	return rez, nil
+}
+
+// parseHexAddress 解析形如 0100007F:1F90 的地址。
+// 地址是按4字节一组、主机字节序（小端）输出的，ipv4是1组，ipv6是4组。
+func parseHexAddress(s string) (net.IP, int, error) {
+	ss := strings.Split(s, ":")
+	if len(ss) != 2 {
+		return nil, 0, fmt.Errorf("wrong format: %s", s)
+	}
+
+	b, err := hex.DecodeString(ss[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return nil, 0, fmt.Errorf("wrong address length: %s", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+
+	port, err := strconv.ParseUint(ss[1], 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return net.IP(b), int(port), nil
+}
+
+// formatAddress 为了和lsof的输出一致，通配地址返回 *。映射的ipv4地址会输出成ipv4的形式
+func formatAddress(ip net.IP) string {
+	if ip.IsUnspecified() {
+		return "*"
+	}
+
+	return ip.String()
+}
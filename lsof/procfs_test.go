@@ -0,0 +1,71 @@
+package lsof
+
+import (
+	"testing"
+)
+
+func TestProcfsRun(t *testing.T) {
+	p := NewProcfs("testdata/proc")
+	r, err := p.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listens := r.GetListenItems()
+	if len(listens) != 3 {
+		t.Fatalf("%v", listens)
+	}
+	if l := listens[0]; l.PID != 1234 || l.Family != IPv4 || l.BindAddress != "*" || l.BindPort != 8080 {
+		t.Error(l)
+	}
+	// 只bind了的udp socket当成监听
+	if l := listens[1]; l.PID != 1234 || l.Protocol != UDP || l.BindAddress != "*" || l.BindPort != 5000 {
+		t.Error(l)
+	}
+	if l := listens[2]; l.PID != 5678 || l.Family != IPv6 || l.BindAddress != "*" || l.BindPort != 9090 {
+		t.Error(l)
+	}
+
+	ests := r.GetEstablishedItems()
+	if len(ests) != 5 {
+		t.Fatalf("%v", ests)
+	}
+	if e := ests[0]; e.PID != 1234 || e.Protocol != TCP || e.SourceAddress != "10.0.0.5" || e.SourcePort != 40000 || e.TargetAddress != "10.0.0.9" || e.TargetPort != 3306 {
+		t.Error(e)
+	}
+	if e := ests[1]; e.PID != 1234 || e.SourcePort != 8080 || e.TargetAddress != "10.0.0.20" || e.TargetPort != 51000 {
+		t.Error(e)
+	}
+	if e := ests[2]; e.PID != 1234 || e.Protocol != UDP || e.TargetAddress != "10.0.0.30" || e.TargetPort != 3478 {
+		t.Error(e)
+	}
+	// 双栈socket上的ipv4连接
+	if e := ests[3]; e.PID != 5678 || e.Family != IPv4 || e.SourceAddress != "10.0.0.5" || e.TargetAddress != "10.0.0.7" || e.TargetPort != 52000 {
+		t.Error(e)
+	}
+	if e := ests[4]; e.PID != 5678 || e.Family != IPv6 || e.SourceAddress != "2001:db8::5" || e.TargetAddress != "2001:db8::1" || e.TargetPort != 443 {
+		t.Error(e)
+	}
+}
+
+func TestParseHexAddress(t *testing.T) {
+	addr, port, err := parseHexAddress("0100007F:1F90")
+	if err != nil || addr.String() != "127.0.0.1" || port != 8080 {
+		t.Error(addr, port, err)
+	}
+
+	addr, port, err = parseHexAddress("00000000000000000000000001000000:0050")
+	if err != nil || addr.String() != "::1" || port != 80 {
+		t.Error(addr, port, err)
+	}
+
+	addr, _, err = parseHexAddress("00000000000000000000000000000000:0050")
+	if err != nil || formatAddress(addr) != "*" {
+		t.Error(addr, err)
+	}
+
+	_, _, err = parseHexAddress("0100007F")
+	if err == nil {
+		t.Error("expect error")
+	}
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
-	"regexp"
-	"strconv"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sevlyar/go-daemon"
@@ -14,107 +16,173 @@ import (
 	"github.com/golang/glog"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/wanghengwei/monclient/conf"
+	"github.com/wanghengwei/monclient/exporter"
+	"github.com/wanghengwei/monclient/filenotify"
+	"github.com/wanghengwei/monclient/lsof"
+	"github.com/wanghengwei/monclient/net"
 	"github.com/wanghengwei/monclient/proc"
 )
 
 var (
-	cpu = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "x51",
-		Name:      "cpu_usage",
-		Help:      "CPU Usage",
-	}, []string{"cmd", "pid"})
-
-	mem = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "x51",
-		Name:      "mem_virt",
-		Help:      "Memory Usage",
-	}, []string{"cmd", "pid"})
-
-	netRecv = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "x51",
-		Name:      "net_recv",
-		Help:      "Received Bytes",
-	}, []string{"cmd", "pid", "port"})
-
-	// 发送的字节数
-	netSendFrom = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "x51",
-		Name:      "net_sendfrom",
-		Help:      "send bytes from local port",
-	}, []string{"cmd", "pid", "port"})
-
-	// 向某个远程地址发送的字节数
-	netSendTo = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "x51",
-		Name:      "net_sendto",
-		Help:      "send bytes to remote address",
-	}, []string{"cmd", "pid", "addr", "port"})
-
 	// 收的event
-	eventRecvCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	eventRecvCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "x51",
 		Name:      "event_recv_count",
 		Help:      "Count of Received Events",
 	}, []string{"service", "pid", "event"})
 
-	eventRecvSize = promauto.NewCounterVec(prometheus.CounterOpts{
+	eventRecvSize = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "x51",
 		Name:      "event_recv_size",
 		Help:      "Size of Received Events",
 	}, []string{"service", "pid", "event"})
 
 	// 发的event
-	eventSendCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	eventSendCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "x51",
 		Name:      "event_send_count",
 		Help:      "Count of Sent Events",
 	}, []string{"service", "pid", "event"})
 
-	eventSendSize = promauto.NewCounterVec(prometheus.CounterOpts{
+	eventSendSize = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "x51",
 		Name:      "event_send_size",
 		Help:      "Size of Sent Events",
 	}, []string{"service", "pid", "event"})
 
 	// args
-	runAsDaemon = flag.Bool("d", false, "as daemon")
+	runAsDaemon    = flag.Bool("d", false, "as daemon")
+	procSource     = flag.String("source", "procfs", "where process info comes from: procfs or ps")
+	sockSource     = flag.String("sockets", "procfs", "where socket info comes from: procfs or lsof")
+	trafficBackend = flag.String("traffic", "iptables", "how traffic is counted: iptables or nftables")
+	cleanup        = flag.Bool("cleanup", false, "remove all traffic rules created by monclient and exit")
+	staleGrace     = flag.Duration("stale-grace", time.Minute, "how long metrics of exited processes and closed connections are kept before removal")
+	configFile     = flag.String("config", "", "config file in JSON or YAML, layered under the config server, and reloaded when it changes")
+	configInterval = flag.Duration("config-interval", time.Minute, "how often config is fetched from the config server")
+	configTimeout  = flag.Duration("config-timeout", 10*time.Second, "timeout of fetching config from the config server")
+	hostLabels     = flag.String("labels", "", "labels of this host like role=gateway,zone=sh, used to select rule blocks in config")
+	checkConfig    = flag.String("check-config", "", "check the given config file, print all problems and exit")
+	printConfig    = flag.Bool("print-config", false, "print the effective config and where each value comes from, then exit")
+	cgroupRoot     = flag.String("cgroup-root", "/sys/fs/cgroup", "where cgroupfs is mounted, for resource usage of units and containers")
+	configCache    = flag.String("config-cache", "/tmp/monclient-config.json", "last good config from the config server is kept here and used when the server is unreachable at startup")
+
+	// 每个配置字段都可以用命令行参数覆盖，比如 -listen-address
+	settingFlags = conf.RegisterFlags(flag.CommandLine)
 )
 
 // App 总入口
 type App struct {
-	config     *conf.Config
-	configMux  sync.Mutex
-	cfgLoaders []conf.ConfigLoader
+	// 合并后的配置
+	config    *conf.Config
+	configMux sync.Mutex
+	// 优先级从低到高：默认值、配置文件、配置服务器、环境变量、命令行参数
+	layers     conf.Layers
+	fileLayer  *conf.Layer
+	httpLayer  *conf.Layer
+	fileLoader *conf.FileConfigLoader
+	httpLoader *conf.HttpConfigLoader
+	// 配置服务器连不上时读上次成功读到的配置
+	cacheLoader *conf.FileConfigLoader
+	// 本机的信息，用来选择配置里的rules
+	host *conf.Host
+	// 配置变化时要更新采集间隔
+	collector *exporter.Collector
+	// 退出前要做的，比如daemon方式运行时删掉pid文件。os.Exit不会执行defer
+	release func()
 }
 
-func NewApp() *App {
+// NewApp 创建App，读取除配置服务器以外的各层配置。configFile 为空表示没有配置文件
+func NewApp(configFile string) (*App, error) {
+	env, err := conf.EnvLayer(os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := settingFlags.Layer()
+	if err != nil {
+		return nil, err
+	}
+
 	app := &App{
-		config: &conf.Config{},
+		fileLayer: conf.NewLayer("file"),
+		httpLayer: conf.NewLayer("http"),
+	}
+	app.layers = conf.Layers{conf.DefaultLayer(), app.fileLayer, app.httpLayer, env, flags}
+
+	if configFile != "" {
+		app.fileLoader = conf.NewFileConfigLoader(configFile, app.fileLayer)
+		err = app.fileLoader.Load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	app.config, _, err = app.layers.Merge()
+	if err != nil {
+		return nil, err
 	}
-	app.cfgLoaders = []conf.ConfigLoader{
-		conf.NewHttpConfigLoader("http://cfg.monitor.tac.com/monclient-default.json", app.config),
-		conf.NewDefaultConfigLoader(app.config),
+
+	// 配置服务器的地址本身不能从配置服务器读
+	if url := app.config.Agent.ConfigURL; url != "" {
+		app.httpLoader = conf.NewHttpConfigLoader(url, *configTimeout, *configCache, app.httpLayer)
+		app.httpLoader.SetCheck(func(values map[string]interface{}) error {
+			return app.layers.Check(app.httpLayer, values)
+		})
+		app.cacheLoader = conf.NewFileConfigLoader(*configCache, app.httpLayer)
 	}
 
-	return app
+	return app, nil
 }
 
+// loadConfig 启动时从配置服务器读取配置，读不到的话用缓存
 func (app *App) loadConfig() {
 	app.configMux.Lock()
 	defer app.configMux.Unlock()
 
-	for _, cl := range app.cfgLoaders {
-		err := cl.Load()
-		if err == nil {
-			glog.Infof("load config done. config=%v\n", app.config)
-			break
-		} else {
-			glog.Infof("load config error, try next ConfigLoader. error=%s\n", err)
+	if app.httpLoader != nil {
+		err := app.httpLoader.Load()
+		if err != nil {
+			glog.Infof("load config error, try cache. error=%s\n", err)
+			err = app.cacheLoader.Load()
+			if err != nil {
+				glog.Infof("load config cache error. error=%s\n", err)
+			}
 		}
 	}
+
+	app.merge()
+}
+
+// reloadConfig 只用一个loader重新加载配置，失败时保留原来的配置
+func (app *App) reloadConfig(cl conf.ConfigLoader) {
+	app.configMux.Lock()
+	defer app.configMux.Unlock()
+
+	err := cl.Load()
+	if err != nil {
+		glog.Errorf("reload config failed, keep the old one. error=%s\n", err)
+		return
+	}
+
+	app.merge()
+}
+
+// merge 重新合并各层配置。要持有configMux
+func (app *App) merge() {
+	cfg, _, err := app.layers.Merge()
+	if err != nil {
+		glog.Errorf("merge config failed, keep the old one. error=%s\n", err)
+		return
+	}
+
+	app.config = cfg
+	if app.collector != nil {
+		app.collector.SetMaxAge(time.Duration(cfg.Agent.SnapInterval))
+		app.collector.SetRollup(cfg.Agent.Rollup)
+	}
+	glog.Infof("load config done. config=%v\n", app.config)
 }
 
 func (app *App) getConfig() conf.Config {
@@ -126,55 +194,85 @@ func (app *App) getConfig() conf.Config {
 
 // Run 执行主任务。不会返回
 func (app *App) Run() error {
+	labels, err := conf.ParseLabels(*hostLabels)
+	if err != nil {
+		return err
+	}
+	app.host, err = conf.LocalHost(labels)
+	if err != nil {
+		return err
+	}
 
-	app.loadConfig()
+	src, err := proc.NewSource(*procSource)
+	if err != nil {
+		return err
+	}
+	sockets, err := lsof.NewProvider(*sockSource)
+	if err != nil {
+		return err
+	}
+	backend, err := net.NewBackend(*trafficBackend)
+	if err != nil {
+		return err
+	}
 
-	// 后台更新config
-	go func() {
-		time.Sleep(25 * time.Second)
-		app.loadConfig()
-	}()
+	pm := proc.NewProcessMonitor()
+	pm.SetSource(src)
+	pm.SetSocketProvider(sockets)
+	pm.SetTrafficBackend(backend)
 
-	// 获得cpu、mem等数据，这些数据来源于周期性的执行系统命令，比如ps
+	// 退出时把创建的规则都删掉
 	go func() {
-		pm := proc.NewProcessMonitor()
-
-		for {
-			// 每次循环开头都应用下配置，因为配置可能会运行时刷新
-			cfg := app.getConfig()
-
-			glog.V(1).Infof("config=%v\n", cfg)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		glog.Infof("got signal %s, cleaning up\n", sig)
+		if err := pm.Close(); err != nil {
+			glog.Errorf("clean up traffic rules failed: %s\n", err)
+		}
+		app.release()
+		os.Exit(0)
+	}()
 
-			// 设置本地端口黑名单
-			pm.ClearBlacklist()
-			setPortBlacklist(cfg.Port.Excludes, pm.AddSinglePortToLocalBlacklist, pm.AddPortRangeToLocalBlacklist)
-			setPortBlacklist(cfg.Port.Excludes, pm.AddSinglePortToRemoteBlacklist, pm.AddPortRangeToRemoteBlacklist)
+	// 每次抓取时采集cpu、mem等数据，距上次采集太近的话直接用上次的
+	app.collector = exporter.NewCollector(&appMonitor{app: app, pm: pm, cgroups: proc.NewCgroupReader(*cgroupRoot)}, time.Duration(app.getConfig().Agent.SnapInterval), *staleGrace)
 
-			// 设置进程黑白名单
-			pm.AddIncludes(cfg.Command.Includes...)
-			pm.AddExcludes(cfg.Command.Excludes...)
+	app.loadConfig()
+	// 标签在注册以后不能变，只在启动时读一次
+	if app.getConfig().Agent.CgroupLabels {
+		app.collector.EnableCgroupLabels()
+	}
 
-			log.Printf("snapping...\n")
-			err := pm.Snap()
+	if app.fileLoader != nil {
+		// 配置文件改了就重新加载，下一次采集时生效
+		go func() {
+			w, err := filenotify.New()
+			if err == nil {
+				err = app.fileLoader.Watch(w, func() {
+					app.reloadConfig(app.fileLoader)
+				})
+			}
 			if err != nil {
-				log.Println("Snap FAILED: %s\n", err)
-			} else {
-				for _, proc := range pm.Procs {
-					cpu.WithLabelValues(proc.Command, strconv.Itoa(proc.PID)).Set(float64(proc.CPU))
-					mem.WithLabelValues(proc.Command, strconv.Itoa(proc.PID)).Set(float64(proc.MemoryVirtual))
-					for _, l := range proc.ListenPorts {
-						netRecv.WithLabelValues(proc.Command, strconv.Itoa(proc.PID), strconv.Itoa(l.Port)).Set(float64(l.InBytes))
-						netSendFrom.WithLabelValues(proc.Command, strconv.Itoa(proc.PID), strconv.Itoa(l.Port)).Set(float64(l.OutBytes))
-					}
-					for _, c := range proc.ClientConns {
-						netSendTo.WithLabelValues(proc.Command, strconv.Itoa(proc.PID), c.Address, strconv.Itoa(c.Port)).Set(float64(c.Bytes))
-					}
-				}
+				glog.Errorf("watch config file failed: %s\n", err)
+			}
+		}()
+	}
+	if app.httpLoader != nil {
+		// 后台定期更新config
+		go func() {
+			for range time.Tick(*configInterval) {
+				app.reloadConfig(app.httpLoader)
 			}
+		}()
+	}
 
-			time.Sleep(10 * time.Second)
-		}
-	}()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		app.collector,
+		eventRecvCount, eventRecvSize, eventSendCount, eventSendSize,
+	)
 
 	// 通过log来分析event数量
 	// go func() {
@@ -192,17 +290,189 @@ func (app *App) Run() error {
 	// 	}
 	// }()
 
-	http.Handle("/metrics", promhttp.Handler())
-	return http.ListenAndServe(":10001", nil)
+	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	// 监听地址只在启动时读一次
+	return http.ListenAndServe(app.getConfig().Agent.ListenAddress, nil)
+}
+
+// appMonitor 每次采集前先应用当前的配置，因为配置可能会运行时刷新
+type appMonitor struct {
+	app     *App
+	pm      *proc.ProcessMonitor
+	cgroups *proc.CgroupReader
+}
+
+func (m *appMonitor) Snap() ([]*proc.Proc, error) {
+	// 只用对本机生效的配置
+	cfg := m.app.getConfig().ForHost(m.app.host)
+
+	glog.V(1).Infof("config=%v\n", cfg)
+
+	// 设置本地端口黑名单
+	m.pm.ClearBlacklist()
+	for _, r := range cfg.ExcludedPorts() {
+		if r.Single() {
+			m.pm.AddSinglePortToLocalBlacklist(r.From)
+			m.pm.AddSinglePortToRemoteBlacklist(r.From)
+		} else {
+			m.pm.AddPortRangeToLocalBlacklist(r.From, r.To)
+			m.pm.AddPortRangeToRemoteBlacklist(r.From, r.To)
+		}
+	}
+
+	// 设置进程黑白名单。配置加载时已经检查过了，这里一般不会出错
+	if err := m.pm.AddIncludes(cfg.Command.Includes...); err != nil {
+		glog.Errorf("bad include pattern: %s\n", err)
+	}
+	if err := m.pm.AddExcludes(cfg.Command.Excludes...); err != nil {
+		glog.Errorf("bad exclude pattern: %s\n", err)
+	}
+	if err := m.pm.AddContainerIncludes(cfg.Cgroup.Containers.Includes...); err != nil {
+		glog.Errorf("bad container include pattern: %s\n", err)
+	}
+	if err := m.pm.AddContainerExcludes(cfg.Cgroup.Containers.Excludes...); err != nil {
+		glog.Errorf("bad container exclude pattern: %s\n", err)
+	}
+	if err := m.pm.AddUnitIncludes(cfg.Cgroup.Units.Includes...); err != nil {
+		glog.Errorf("bad unit include pattern: %s\n", err)
+	}
+	if err := m.pm.AddUnitExcludes(cfg.Cgroup.Units.Excludes...); err != nil {
+		glog.Errorf("bad unit exclude pattern: %s\n", err)
+	}
+
+	// 对外连接的汇总方式
+	clients, err := newClientAggregator(&cfg.Client)
+	if err != nil {
+		glog.Errorf("bad client config: %s\n", err)
+	}
+	m.pm.SetClientAggregator(clients)
+
+	// 按远端地址统计进来流量的监听端口
+	peers := make(map[int]proc.PeerLimit)
+	for _, p := range cfg.Port.Peers {
+		limit := proc.PeerLimit{Top: p.Top, MaxTracked: p.MaxTracked}
+		if limit.Top == 0 {
+			limit.Top = conf.DefaultPeerTop
+		}
+		if limit.MaxTracked == 0 {
+			limit.MaxTracked = conf.DefaultPeerMaxTracked
+		}
+		if limit.MaxTracked < limit.Top {
+			limit.MaxTracked = limit.Top
+		}
+		peers[p.Port] = limit
+	}
+	m.pm.SetPeerPorts(peers)
+
+	// 进程分组，组名会作为group标签导出
+	groups := []*proc.Group{}
+	for _, g := range cfg.Groups {
+		pg, err := proc.NewGroup(g.Name, g.Command.Includes, g.Command.Excludes, g.User, g.Cgroup)
+		if err != nil {
+			glog.Errorf("bad group %s: %s\n", g.Name, err)
+			continue
+		}
+		pg.Descendants = g.Command.Descendants
+		pg.Smaps = g.Smaps
+		groups = append(groups, pg)
+	}
+	m.pm.SetGroups(groups)
+	m.pm.SetDescendants(cfg.Command.Descendants)
+	m.pm.SetRestartWindow(time.Duration(cfg.Agent.RestartWindow))
+	if cfg.Agent.CgroupStats {
+		m.pm.SetCgroupReader(m.cgroups)
+	} else {
+		m.pm.SetCgroupReader(nil)
+	}
+	m.pm.SetTrafficByCgroup(cfg.Agent.TrafficMode == conf.TrafficByCgroup)
+
+	log.Printf("snapping...\n")
+	err = m.pm.Snap()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.pm.Procs, nil
+}
+
+// newClientAggregator 按配置创建对外连接的汇总方式。配置加载时已经检查过了，出错的服务跳过
+func newClientAggregator(c *conf.ClientConfig) (*proc.ClientAggregator, error) {
+	a, err := proc.NewClientAggregator(c.Aggregate, c.IPv4Prefix, c.IPv6Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, svc := range c.Services {
+		if err := a.AddService(svc.Name, svc.CIDRs...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return a, firstErr
+}
+
+func (m *appMonitor) Events() []proc.Event {
+	return m.pm.Events()
+}
+
+func (m *appMonitor) Cgroups() []*proc.Cgroup {
+	return m.pm.Cgroups()
+}
+
+func (m *appMonitor) CgroupTraffic() []*proc.CgroupTraffic {
+	return m.pm.CgroupTraffic()
+}
+
+func (m *appMonitor) TrafficRuleFailures() uint64 {
+	return m.pm.TrafficRuleFailures()
 }
 
 func main() {
 	flag.Parse()
 
+	// 只检查配置文件
+	if *checkConfig != "" {
+		os.Exit(runCheckConfig(*checkConfig))
+	}
+
+	// 只清理规则，比如进程被kill -9之后
+	if *cleanup {
+		backend, err := net.NewBackend(*trafficBackend)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := backend.Close(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	app, err := NewApp(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 打印合并后的配置，包括配置服务器上的
+	if *printConfig {
+		app.loadConfig()
+		if err := app.layers.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// pid文件和日志目录在连配置服务器之前就要用，所以配置服务器上的不起作用
+	cfg := app.getConfig()
+	if cfg.Agent.LogFolder != "" {
+		flag.Set("log_dir", cfg.Agent.LogFolder)
+	}
+
+	app.release = func() {}
 	// 这段if是为了用daemon方式运行
 	if *runAsDaemon {
 		ctx := daemon.Context{
-			PidFileName: "/tmp/monclient.pid",
+			PidFileName: cfg.Agent.PidFile,
 			WorkDir:     "/tmp",
 		}
 		d, err := ctx.Reborn()
@@ -212,27 +482,40 @@ func main() {
 		if d != nil {
 			return
 		}
-		defer ctx.Release()
+		app.release = func() {
+			if err := ctx.Release(); err != nil {
+				glog.Errorf("release daemon context failed: %s\n", err)
+			}
+		}
 	}
 
-	// 启动应用
-	app := NewApp()
+	// 启动应用。正常不会返回，收到信号时在Run里退出
 	if err := app.Run(); err != nil {
+		app.release()
 		log.Fatal(err)
 	}
 }
 
-func setPortBlacklist(ports []string, f1 func(int), f2 func(int, int)) {
-	numberRe := regexp.MustCompile(`^(\d+)$`)
-	rangeRe := regexp.MustCompile(`^(\d+)-(\d+)$`)
-	for _, s := range ports {
-		if ss := numberRe.FindStringSubmatch(s); len(ss) > 0 {
-			port, _ := strconv.Atoi(ss[1])
-			f1(port)
-		} else if ss := rangeRe.FindStringSubmatch(s); len(ss) > 0 {
-			a, _ := strconv.Atoi(ss[1])
-			b, _ := strconv.Atoi(ss[2])
-			f2(a, b)
+// runCheckConfig 检查配置文件，有问题的话一行一个打出来。返回进程的退出码
+func runCheckConfig(path string) int {
+	layer := conf.NewLayer("file")
+	err := conf.NewFileConfigLoader(path, layer).Load()
+	if err == nil {
+		// 和默认值合并以后也要没问题
+		_, _, err = conf.Layers{conf.DefaultLayer(), layer}.Merge()
+	}
+	if err == nil {
+		fmt.Printf("%s: ok\n", path)
+		return 0
+	}
+
+	if ve, ok := err.(*conf.ValidationError); ok {
+		for _, p := range ve.Problems {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, p)
 		}
+	} else {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 	}
+
+	return 1
 }
@@ -3,350 +3,476 @@ package net
 import (
 	"fmt"
 	"log"
-	"os/exec"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/wanghengwei/monclient/cmdutil"
-	"github.com/wanghengwei/monclient/common"
 )
 
-// TrafficMonitor is tool for TrafficMonitor
-type TrafficMonitor struct {
-	inputs            []*InputItem
-	clientConnections []*ClientConnection
+// 对应的命令
+func (f Family) command() string {
+	if f == IPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
 }
 
-// NewTrafficMonitor TODO
-func NewTrafficMonitor() *TrafficMonitor {
-	return &TrafficMonitor{}
-}
+// 我们自己的链。INPUT和OUTPUT里只有一条跳到这里的规则，其它规则都在这两个链里，
+// 这样不会动到别人加的规则
+const (
+	chainIn  = "MONCLIENT-IN"
+	chainOut = "MONCLIENT-OUT"
+)
 
-// ClearAll 清除当前记录的所有端口信息
-func (t *TrafficMonitor) ClearAll() {
-	t.inputs = nil
-	t.clientConnections = nil
+// 系统的链 -> 我们的链
+var chainJumps = [][2]string{
+	{"INPUT", chainIn},
+	{"OUTPUT", chainOut},
 }
 
-// AddInput 添加一个需要统计的监听端口
-// 这个端口会被加到INPUT/OUTPUT chain里
-func (t *TrafficMonitor) AddInput(pid int, port int) {
-	t.inputs = append(t.inputs, &InputItem{
-		PID:   pid,
-		Port:  port,
-		ready: false,
-	})
-}
+// IPTables 用iptables/ip6tables的规则来统计流量。规则放在 MONCLIENT-IN 和 MONCLIENT-OUT 里，
+// 用comment来标记是哪个进程的
+type IPTables struct {
+	runner Runner
 
-// AddClientConnection 添加一个作为客户端连出去的iptables rule
-// port 表示远程目标端口
-func (t *TrafficMonitor) AddClientConnection(pid int, addr string, port int) {
-	t.clientConnections = append(t.clientConnections, &ClientConnection{
-		PID:     pid,
-		Address: addr,
-		Port:    port,
-		ready:   false,
-	})
+	// 是否已经检查过支不支持cgroup match，以及结果
+	probed   bool
+	cgroupOK bool
 }
 
-// InputItem represent a listening socket
-type InputItem struct {
-	PID      int
-	Port     int
-	InBytes  uint64
-	OutBytes uint64
-	ready    bool
+// NewIPTables 创建一个IPTables
+func NewIPTables(r Runner) *IPTables {
+	return &IPTables{runner: r}
 }
 
-// ClientConnection 表示作为客户端向外的连接，不包括监听端口对外发包的方向
-type ClientConnection struct {
-	PID int
-	// 远端的地址，比如ip
-	Address string
-	// 远端目标端口
-	Port int
-	// 发送的字节数
-	Bytes uint64
-	ready bool
+// Snap 依次处理每个地址族的 MONCLIENT-IN、MONCLIENT-OUT。
+// 部分规则应用失败时，其它规则的计数照常填好，返回 *RuleError
+func (b *IPTables) Snap(inputs []*InputItem, clients []*ClientConnection) error {
+	return b.SnapWithCgroups(inputs, clients, nil)
 }
 
-// Snap run command one time
-func (t *TrafficMonitor) Snap() error {
-	err := t.snapInput("INPUT")
-	if err != nil {
-		return err
-	}
+// SnapWithCgroups 同Snap，另外每个cgroup在 MONCLIENT-OUT 里有一条 -m cgroup --path 的规则。
+// 一个地址族整个失败（比如没有ip6tables、关了ipv6）不影响别的地址族，都失败才返回那个错误
+func (b *IPTables) SnapWithCgroups(inputs []*InputItem, clients []*ClientConnection, cgroups []*CgroupItem) error {
+	failures := []error{}
+	skipped := []Family{}
+	var firstErr error
 
-	err = t.snapInput("OUTPUT")
-	if err != nil {
-		return err
+	for _, family := range Families {
+		fs, err := b.snapFamilyWithChains(family, inputs, clients, cgroups)
+		if err != nil {
+			log.Printf("snap %s failed, skip: %s\n", family, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			skipped = append(skipped, family)
+			failures = append(failures, fmt.Errorf("%s: %s", family, err))
+			continue
+		}
+		failures = append(failures, fs...)
 	}
 
-	err = t.snapClient()
-	if err != nil {
-		return err
+	if len(skipped) == len(Families) {
+		return firstErr
+	}
+	if len(failures) > 0 {
+		return &RuleError{Failures: failures, Skipped: skipped}
 	}
 
 	return nil
 }
 
-// FindInputTraffics 获得一个监听端口的流量总字节(in and out)
-func (t *TrafficMonitor) FindInputTraffics(pid int, port int) (uint64, uint64) {
-	for _, item := range t.inputs {
-		if item.PID == pid && item.Port == port {
-			return item.InBytes, item.OutBytes
-		}
+func (b *IPTables) snapFamilyWithChains(family Family, inputs []*InputItem, clients []*ClientConnection, cgroups []*CgroupItem) ([]error, error) {
+	if err := b.ensureChains(family); err != nil {
+		return nil, err
 	}
 
-	return 0, 0
+	return b.snapFamily(family, inputs, clients, cgroups)
 }
 
-// FindOutputBytes 获得一个对外连接的流量总字节
-func (t *TrafficMonitor) FindClientOutput(pid int, addr string, port int) uint64 {
-	for _, item := range t.clientConnections {
-		if item.PID == pid && item.Port == port && item.Address == addr {
-			return item.Bytes
-		}
+// SupportsCgroups 检查能不能用cgroup match：要有xt_cgroup模块，而且cgroup v2的 --path 才行。
+// 在 MONCLIENT-OUT 里试着加一条再删掉，只检查一次
+func (b *IPTables) SupportsCgroups() bool {
+	if b.probed {
+		return b.cgroupOK
 	}
 
-	return 0
-}
+	if err := b.ensureChains(IPv4); err != nil {
+		log.Printf("probe cgroup match failed: %s\n", err)
+		return false
+	}
+	b.probed = true
 
-func listRules(chain string) ([]*cmdutil.CommandResultLine, error) {
-	lines, err := cmdutil.RunCommand("iptables", "-x", "-n", "-v", "-L", chain, "--line-numbers")
-	if err != nil {
-		return nil, err
+	spec := []string{chainOut, "-m", "cgroup", "--path", "/", "-m", "comment", "--comment", "type=probe"}
+	if _, err := b.runner.Run("", IPv4.command(), append([]string{"-A"}, spec...)...); err != nil {
+		log.Printf("cgroup match is not supported: %s\n", err)
+		return false
+	}
+	if _, err := b.runner.Run("", IPv4.command(), append([]string{"-D"}, spec...)...); err != nil {
+		// 删不掉的话下次Snap会当成不需要的规则删掉
+		log.Printf("remove probe rule failed: %s\n", err)
 	}
 
-	return lines, nil
+	b.cgroupOK = true
+	return true
 }
 
-// 获得监听端口的信息
-func (t *TrafficMonitor) snapInput(chain string) error {
-	// chain := "INPUT"
-
-	lines, err := listRules(chain)
-	if err != nil {
+// Close 删掉INPUT/OUTPUT里的跳转，再清空并删除我们的链。
+// 每一步出错都继续往下做，最后返回第一个错误
+func (b *IPTables) Close() error {
+	var firstErr error
+	run := func(family Family, args ...string) error {
+		_, err := b.runner.Run("", family.command(), args...)
+		if err != nil {
+			log.Printf("clean up failed: %s\n", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
 		return err
 	}
 
-	for _, item := range t.inputs {
-		item.ready = false
+	for _, family := range Families {
+		for _, j := range chainJumps {
+			// 链不存在就不用删了
+			if _, err := b.runner.Run("", family.command(), "-n", "-L", j[1]); err != nil {
+				continue
+			}
+
+			// 跳转可能被重复加过，全部删掉
+			for b.hasJump(family, j[0], j[1]) {
+				if run(family, "-D", j[0], "-j", j[1]) != nil {
+					break
+				}
+			}
+			run(family, "-F", j[1])
+			run(family, "-X", j[1])
+		}
 	}
 
-	// line 每行大概长这样
-	// 1 0 0 tcp -- * * 0.0.0.0/0 0.0.0.0/0 tcp dpt:1080 /* pid=10234;type=server */
+	return firstErr
+}
 
-	toDel := []string{}
+// ensureChains 创建我们的链，并在INPUT/OUTPUT的最前面加上跳转
+func (b *IPTables) ensureChains(family Family) error {
+	for _, j := range chainJumps {
+		if _, err := b.runner.Run("", family.command(), "-n", "-L", j[1]); err != nil {
+			log.Printf("create chain %s(%s)\n", j[1], family)
+			if _, err := b.runner.Run("", family.command(), "-N", j[1]); err != nil {
+				return err
+			}
+		}
 
-	for _, l := range lines {
-		if len(l.Fields) != 14 {
-			log.Printf("line is not created by me: %s\n", l)
-			continue
+		if !b.hasJump(family, j[0], j[1]) {
+			log.Printf("add jump %s -> %s(%s)\n", j[0], j[1], family)
+			if _, err := b.runner.Run("", family.command(), "-I", j[0], "-j", j[1]); err != nil {
+				return err
+			}
 		}
+	}
 
-		ruleNumber := l.GetField(0).String()
+	return nil
+}
 
-		tmp, err := l.GetField(12).FindSubmatches(`pid=(\d+);type=(.*)`)
-		if err != nil || len(tmp) != 3 {
-			// remove it
-			log.Printf("cannot find server rule: line=%s, err=%s\n", l, err)
-			toDel = append(toDel, ruleNumber)
-			continue
-		}
-		if tmp[2] != "server" {
-			// 不是监听的端口的rule，跳过
-			log.Printf("type is not server, skip\n")
-			continue
-		}
+func (b *IPTables) hasJump(family Family, from string, to string) bool {
+	_, err := b.runner.Run("", family.command(), "-C", from, "-j", to)
+	return err == nil
+}
 
-		pid, err := strconv.Atoi(tmp[1])
-		if err != nil {
-			toDel = append(toDel, ruleNumber)
-			continue
-		}
+// 规则的身份。两条规则身份一样就认为是同一条，不管它在链里的第几行
+type ruleKey struct {
+	chain    string
+	kind     string
+	protocol Protocol
+	pid      int
+	port     int
+	address  string
+}
 
-		// 找到端口。可能是目标也可能是源
-		var pt string
-		if chain == "INPUT" {
-			pt = `dpt:(\d+)`
-		} else {
-			// 对外则作为源端口
-			pt = `spt:(\d+)`
-		}
-		port := l.GetField(10).FindSubmatch(pt).AsInt()
+// 一条需要存在的规则
+type iptablesWanted struct {
+	key ruleKey
+	// 不带 -A 的规则内容，比如 MONCLIENT-IN -p tcp -m tcp --dport 80 -m comment --comment "pid=1;type=server"
+	spec string
+	// 统计到的字节数和包数写到这里
+	bytes   *uint64
+	packets *uint64
+}
 
-		if port == 0 {
-			// bad line , to be removed
-			log.Printf("bad line, port is 0: %s", l)
-			toDel = append(toDel, ruleNumber)
-			continue
-		}
+// 从iptables-save里读出来的一条我们链里的规则
+type iptablesRule struct {
+	key     ruleKey
+	spec    string
+	bytes   uint64
+	packets uint64
+}
 
-		// 找到这个监听端口的信息
-		item := t.findInput(pid, port)
-		if item == nil {
-			log.Printf("remove unwanted item: num=%d, pid=%d, port=%d", ruleNumber, pid, port)
-			toDel = append(toDel, ruleNumber)
-			continue
-		}
+// listRules 用iptables-save读出我们链里的所有规则，带计数
+// 每行大概长这样
+// [10:1000] -A MONCLIENT-IN -p tcp -m tcp --dport 1080 -m comment --comment "pid=10234;type=server"
+// [3:300] -A MONCLIENT-OUT -d 1.2.3.4/32 -p tcp -m tcp --dport 1080 -m comment --comment "pid=10234;type=client"
+func (b *IPTables) listRules(family Family) ([]*iptablesRule, error) {
+	out, err := b.runner.Run("", family.command()+"-save", "-c", "-t", "filter")
+	if err != nil {
+		return nil, err
+	}
 
-		// read the bytes stat
-		bs, err := common.DataStrToBytes(l.GetField(2).String())
-		if err != nil {
-			log.Printf("convert recv %s to bytes failed\n", l.GetField(2))
-			toDel = append(toDel, ruleNumber)
-			continue
+	rules := []*iptablesRule{}
+	for _, l := range cmdutil.ParseLines(out, true, -1) {
+		r := parseSaveLine(l.String())
+		if r != nil {
+			rules = append(rules, r)
 		}
+	}
 
-		if chain == "INPUT" {
-			item.InBytes = bs
-		} else {
-			item.OutBytes = bs
-		}
+	return rules, nil
+}
 
-		item.ready = true
+// parseSaveLine 解析iptables-save的一行。不是我们链里的返回nil。
+// 我们链里解析不了的规则，key是空的，不会和任何需要的规则匹配，所以会被删掉
+func parseSaveLine(line string) *iptablesRule {
+	args := splitRuleSpec(line)
+	if len(args) < 3 || args[1] != "-A" || (args[2] != chainIn && args[2] != chainOut) {
+		return nil
 	}
 
-	// delete unwanted rules
-	for _, item := range toDel {
-		exec.Command("iptables", "-D", chain, item).Run()
+	r := &iptablesRule{
+		spec: strings.TrimSpace(line[strings.Index(line, "-A ")+3:]),
 	}
 
-	// create rule for non-ready items
-	for _, item := range t.inputs {
-		if item.ready {
-			continue
-		}
-
-		log.Printf("create rule in %s: pid=%d, port=%d", chain, item.PID, item.Port)
+	// [packets:bytes]
+	counters := strings.Split(strings.Trim(args[0], "[]"), ":")
+	if len(counters) == 2 {
+		r.packets, _ = strconv.ParseUint(counters[0], 10, 64)
+		r.bytes, _ = strconv.ParseUint(counters[1], 10, 64)
+	}
 
-		var portArg string
-		if chain == "INPUT" {
-			portArg = "--dport"
-		} else {
-			portArg = "--sport"
+	key := ruleKey{chain: args[2]}
+	var comment string
+	var sport, dport int
+	for i := 3; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-p":
+			key.protocol = Protocol(args[i+1])
+		case "-d", "-s":
+			key.address = strings.TrimSuffix(strings.TrimSuffix(args[i+1], "/32"), "/128")
+		case "--dport":
+			dport, _ = strconv.Atoi(args[i+1])
+		case "--sport":
+			sport, _ = strconv.Atoi(args[i+1])
+		case "--path":
+			key.address = args[i+1]
+		case "--comment":
+			comment = args[i+1]
 		}
+	}
 
-		exec.Command("iptables", "-I", chain, "-p", "tcp", portArg, strconv.Itoa(item.Port), "-mcomment", "--comment", fmt.Sprintf("pid=%d;type=server", item.PID)).Run()
-		item.ready = true
+	ms := commentPattern.FindStringSubmatch(comment)
+	if ms == nil {
+		return r
+	}
+	key.pid, _ = strconv.Atoi(ms[1])
+	key.kind = ms[2]
+	// 进来的和对外连接看目标端口，监听端口发出去的看源端口
+	if key.chain == chainOut && key.kind == "server" {
+		key.port = sport
+	} else {
+		key.port = dport
 	}
+	r.key = key
 
-	return nil
+	return r
 }
 
-// 获得向外的连接的信息
-func (t *TrafficMonitor) snapClient() error {
-	lines, err := listRules("OUTPUT")
-	if err != nil {
-		return err
+// 按cgroup统计的规则不属于某个进程，没有pid
+var commentPattern = regexp.MustCompile(`^(?:pid=(\d+);)?type=(\w+)$`)
+
+// splitRuleSpec 按空格切分规则，双引号里的空格不切，引号本身去掉
+func splitRuleSpec(s string) []string {
+	rez := []string{}
+	cur := strings.Builder{}
+	inQuote := false
+	hasToken := false
+
+	for _, c := range s {
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+			hasToken = true
+		case c == ' ' && !inQuote:
+			if hasToken {
+				rez = append(rez, cur.String())
+				cur.Reset()
+				hasToken = false
+			}
+		default:
+			cur.WriteRune(c)
+			hasToken = true
+		}
 	}
-
-	for _, item := range t.clientConnections {
-		item.ready = false
+	if hasToken {
+		rez = append(rez, cur.String())
 	}
 
-	// line is like this
-	// 1 0 0 tcp -- * * 0.0.0.0/0 1.2.3.4 tcp dpt:1080 /* pid=10234;type=client */
-
-	toDel := []string{}
-
-	for _, l := range lines {
-		if len(l.Fields) != 14 {
-			log.Printf("line is not created by me: %s\n", l)
-			continue
-		}
+	return rez
+}
 
-		ruleNumber := l.GetField(0).String()
+// iptablesWantedRules 把需要统计的端口和连接转成规则。监听端口进出各一条，
+// 监听端口的每个远端地址只统计进来的，对外连接和cgroup只统计发出的
+func iptablesWantedRules(family Family, inputs []*InputItem, clients []*ClientConnection, cgroups []*CgroupItem) []*iptablesWanted {
+	rez := []*iptablesWanted{}
 
-		tmp, err := l.GetField(12).FindSubmatches(`pid=(\d+);type=(.*)`)
-		if err != nil || len(tmp) != 3 {
-			// remove it
-			log.Printf("cannot find client comment in line: %s", l)
-			toDel = append(toDel, ruleNumber)
-			continue
-		}
-		if tmp[2] != "client" {
-			// 不是监听的端口的rule，跳过
+	for _, item := range inputs {
+		if item.Family != family {
 			continue
 		}
 
-		pid, err := strconv.Atoi(tmp[1])
-		if err != nil {
-			toDel = append(toDel, ruleNumber)
+		if item.Peer != "" {
+			rez = append(rez, &iptablesWanted{
+				key:     ruleKey{chain: chainIn, kind: "peer", protocol: item.Protocol, pid: item.PID, port: item.Port, address: item.Peer},
+				spec:    fmt.Sprintf("%s -s %s -p %s -m %s --dport %d -m comment --comment \"pid=%d;type=peer\"", chainIn, item.Peer, item.Protocol, item.Protocol, item.Port, item.PID),
+				bytes:   &item.InBytes,
+				packets: &item.InPackets,
+			})
 			continue
 		}
 
-		// 目标地址
-		addr := l.GetField(8).String()
-
-		// 目标端口，因此是dpt
-		port := l.GetField(10).FindSubmatch(`dpt:(\d+)`).AsInt()
+		comment := fmt.Sprintf("pid=%d;type=server", item.PID)
+		rez = append(rez, &iptablesWanted{
+			key:     ruleKey{chain: chainIn, kind: "server", protocol: item.Protocol, pid: item.PID, port: item.Port},
+			spec:    fmt.Sprintf("%s -p %s -m %s --dport %d -m comment --comment \"%s\"", chainIn, item.Protocol, item.Protocol, item.Port, comment),
+			bytes:   &item.InBytes,
+			packets: &item.InPackets,
+		}, &iptablesWanted{
+			key:     ruleKey{chain: chainOut, kind: "server", protocol: item.Protocol, pid: item.PID, port: item.Port},
+			spec:    fmt.Sprintf("%s -p %s -m %s --sport %d -m comment --comment \"%s\"", chainOut, item.Protocol, item.Protocol, item.Port, comment),
+			bytes:   &item.OutBytes,
+			packets: &item.OutPackets,
+		})
+	}
 
-		if port == 0 {
-			// bad line , to be removed
-			log.Printf("bad line, port is 0: %s", l)
-			toDel = append(toDel, ruleNumber)
+	for _, item := range clients {
+		if item.Family != family {
 			continue
 		}
 
-		item := t.findClient(pid, addr, port)
-		// the rule is not interested, remove it
-		if item == nil {
-			log.Printf("remove unwanted item(output): pid=%d, port=%d", pid, port)
-			toDel = append(toDel, ruleNumber)
-			continue
+		// 汇总的连接可能没有地址（只按端口）或者没有端口（按服务的网段）
+		spec := chainOut
+		if item.Address != "" {
+			spec += " -d " + item.Address
+		}
+		spec += fmt.Sprintf(" -p %s", item.Protocol)
+		if item.Port != 0 {
+			spec += fmt.Sprintf(" -m %s --dport %d", item.Protocol, item.Port)
 		}
+		spec += fmt.Sprintf(" -m comment --comment \"pid=%d;type=client\"", item.PID)
+
+		rez = append(rez, &iptablesWanted{
+			key:     ruleKey{chain: chainOut, kind: "client", protocol: item.Protocol, pid: item.PID, port: item.Port, address: item.Address},
+			spec:    spec,
+			bytes:   &item.Bytes,
+			packets: &item.Packets,
+		})
+	}
 
-		// read the bytes stat
-		log.Printf("set bytes. line: %s", l)
-		item.Bytes, err = common.DataStrToBytes(l.GetField(2).String())
-		if err != nil {
-			log.Printf("convert send %s to bytes failed\n", l.GetField(2))
-			toDel = append(toDel, ruleNumber)
+	for _, item := range cgroups {
+		if item.Family != family {
 			continue
 		}
 
-		item.ready = true
+		rez = append(rez, &iptablesWanted{
+			key:     ruleKey{chain: chainOut, kind: "cgroup", address: item.Path},
+			spec:    fmt.Sprintf("%s -m cgroup --path %s -m comment --comment \"type=cgroup\"", chainOut, item.Path),
+			bytes:   &item.Bytes,
+			packets: &item.Packets,
+		})
 	}
 
-	// delete unwanted rules
-	for _, item := range toDel {
-		exec.Command("iptables", "-D", "OUTPUT", item).Run()
+	return rez
+}
+
+// snapFamily 比较需要的规则和已有的规则，把计数填进去，然后把差异一次性应用上去
+func (b *IPTables) snapFamily(family Family, inputs []*InputItem, clients []*ClientConnection, cgroups []*CgroupItem) ([]error, error) {
+	actual, err := b.listRules(family)
+	if err != nil {
+		return nil, err
 	}
 
-	// create rule for non-ready items
-	for _, item := range t.clientConnections {
-		if item.ready {
-			continue
+	wanted := iptablesWantedRules(family, inputs, clients, cgroups)
+	wantedKeys := make(map[ruleKey]bool)
+	actualKeys := make(map[ruleKey]*iptablesRule)
+
+	// 同样身份的规则只留最后一条，多余的删掉。-D 按规则删的是第一条一样的，
+	// 多余的都在留下的那条前面，所以留下的那条不会被删，读到的计数也还是它的
+	for _, r := range actual {
+		actualKeys[r.key] = r
+	}
+	toDel := []string{}
+	for _, r := range actual {
+		if actualKeys[r.key] != r {
+			toDel = append(toDel, r.spec)
 		}
+	}
 
-		log.Printf("create output rule: pid=%d, addr=%s, port=%d", item.PID, item.Address, item.Port)
+	toAdd := []string{}
+	for _, w := range wanted {
+		wantedKeys[w.key] = true
+		if r, ok := actualKeys[w.key]; ok {
+			*w.bytes = r.bytes
+			*w.packets = r.packets
+			continue
+		}
 
-		exec.Command("iptables", "-I", "OUTPUT", "-p", "tcp", "-d", item.Address, "--dport", strconv.Itoa(item.Port), "-mcomment", "--comment", fmt.Sprintf("pid=%d;type=client", item.PID)).Run()
+		log.Printf("create rule(%s): %s", family, w.spec)
+		toAdd = append(toAdd, w.spec)
+	}
 
-		item.ready = true
+	for _, r := range actual {
+		if !wantedKeys[r.key] && actualKeys[r.key] == r {
+			log.Printf("remove unwanted rule(%s): %s", family, r.spec)
+			toDel = append(toDel, r.spec)
+		}
 	}
 
-	return nil
+	return b.apply(family, toDel, toAdd), nil
 }
 
-func (t *TrafficMonitor) findInput(pid int, port int) *InputItem {
-	for _, item := range t.inputs {
-		if item.PID == pid && item.Port == port {
-			return item
-		}
+// apply 用iptables-restore一次性删除和添加规则。整批失败的话再一条一条来，返回每条失败的原因
+func (b *IPTables) apply(family Family, toDel []string, toAdd []string) []error {
+	if len(toDel) == 0 && len(toAdd) == 0 {
+		return nil
 	}
 
-	return nil
-}
+	script := strings.Builder{}
+	script.WriteString("*filter\n")
+	for _, spec := range toDel {
+		script.WriteString("-D " + spec + "\n")
+	}
+	for _, spec := range toAdd {
+		script.WriteString("-A " + spec + "\n")
+	}
+	script.WriteString("COMMIT\n")
 
-// 查询一条对外接口记录
-func (t *TrafficMonitor) findClient(pid int, addr string, port int) *ClientConnection {
-	for _, item := range t.clientConnections {
-		if item.PID == pid && item.Address == addr && item.Port == port {
-			return item
+	_, err := b.runner.Run(script.String(), family.command()+"-restore", "--noflush")
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("apply rules in batch failed, try one by one: %s\n", err)
+
+	failures := []error{}
+	for _, op := range []struct {
+		flag  string
+		specs []string
+	}{{"-D", toDel}, {"-A", toAdd}} {
+		for _, spec := range op.specs {
+			args := append([]string{op.flag}, splitRuleSpec(spec)...)
+			if _, err := b.runner.Run("", family.command(), args...); err != nil {
+				failures = append(failures, err)
+			}
 		}
 	}
 
-	return nil
+	return failures
 }
@@ -6,8 +6,8 @@ import (
 
 func TestGetTrafficOfNetwork(t *testing.T) {
 	m := NewTrafficMonitor()
-	m.ClearInputs()
-	m.AddInput(2519, 1080)
+	m.ClearAll()
+	m.AddInput(IPv4, TCP, 2519, 0, 1080)
 	err := m.Snap()
 	if err != nil {
 		t.Error(err)
@@ -0,0 +1,361 @@
+package net
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var errFake = errors.New("fake error")
+
+const iptablesSave = `# Generated by iptables-save v1.8.7 on Thu Jan  1 00:00:00 2020
+*filter
+:INPUT ACCEPT [0:0]
+:MONCLIENT-IN - [0:0]
+:MONCLIENT-OUT - [0:0]
+[100:20000] -A INPUT -j MONCLIENT-IN
+[10:1000] -A MONCLIENT-IN -p tcp -m tcp --dport 8080 -m comment --comment "pid=1234;type=server"
+[1:60] -A MONCLIENT-IN -p tcp -m tcp --dport 80 -m comment --comment "pid=999;type=server"
+[3:300] -A MONCLIENT-OUT -d 1.2.3.4/32 -p tcp -m tcp --dport 3306 -m comment --comment "pid=1234;type=client"
+[0:0] -A MONCLIENT-OUT -p tcp -m tcp --sport 22
+COMMIT
+`
+
+func TestIPTablesCreateChains(t *testing.T) {
+	r := newFakeRunner()
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		r.errors[cmd+" -n -L MONCLIENT-IN"] = errFake
+		r.errors[cmd+" -n -L MONCLIENT-OUT"] = errFake
+		r.errors[cmd+" -C INPUT -j MONCLIENT-IN"] = errFake
+		r.errors[cmd+" -C OUTPUT -j MONCLIENT-OUT"] = errFake
+	}
+
+	err := NewIPTables(r).Snap(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmd := range []string{
+		"iptables -N MONCLIENT-IN",
+		"iptables -N MONCLIENT-OUT",
+		"iptables -I INPUT -j MONCLIENT-IN",
+		"iptables -I OUTPUT -j MONCLIENT-OUT",
+		"ip6tables -N MONCLIENT-IN",
+		"ip6tables -I OUTPUT -j MONCLIENT-OUT",
+	} {
+		if !r.called(cmd) {
+			t.Errorf("not called: %s", cmd)
+		}
+	}
+}
+
+func TestIPTablesSnap(t *testing.T) {
+	r := newFakeRunner()
+	r.outputs["iptables-save -c -t filter"] = iptablesSave
+
+	inputs := []*InputItem{{Family: IPv4, Protocol: TCP, PID: 1234, Port: 8080}}
+	clients := []*ClientConnection{{Family: IPv4, Protocol: TCP, PID: 1234, Address: "1.2.3.4", Port: 3306}}
+	err := NewIPTables(r).Snap(inputs, clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inputs[0].InBytes != 1000 || inputs[0].InPackets != 10 || clients[0].Bytes != 300 || clients[0].Packets != 3 {
+		t.Errorf("%v %v", inputs[0], clients[0])
+	}
+
+	// 链已经存在，不用再建
+	if r.called("iptables -N MONCLIENT-IN") || r.called("iptables -I INPUT -j MONCLIENT-IN") {
+		t.Errorf("%v", r.calls)
+	}
+
+	var script string
+	for i, c := range r.calls {
+		if c == "iptables-restore --noflush" {
+			script = r.stdins[i]
+		}
+	}
+	want := "*filter\n" +
+		"-D MONCLIENT-IN -p tcp -m tcp --dport 80 -m comment --comment \"pid=999;type=server\"\n" +
+		"-D MONCLIENT-OUT -p tcp -m tcp --sport 22\n" +
+		"-A MONCLIENT-OUT -p tcp -m tcp --sport 8080 -m comment --comment \"pid=1234;type=server\"\n" +
+		"COMMIT\n"
+	if script != want {
+		t.Errorf("%q", script)
+	}
+
+	// ipv6里没有规则，也没有要加的，不用restore
+	if r.called("ip6tables-restore --noflush") {
+		t.Errorf("%v", r.calls)
+	}
+}
+
+func TestIPTablesSnapFallback(t *testing.T) {
+	r := newFakeRunner()
+	r.errors["iptables-restore --noflush"] = errFake
+	r.errors["iptables -A MONCLIENT-OUT -p tcp -m tcp --sport 8080 -m comment --comment pid=1234;type=server"] = errFake
+
+	inputs := []*InputItem{{Family: IPv4, Protocol: TCP, PID: 1234, Port: 8080}}
+	m := NewTrafficMonitorWithBackend(NewIPTables(r))
+	m.inputs = inputs
+	err := m.Snap()
+
+	re, ok := err.(*RuleError)
+	if !ok || len(re.Failures) != 1 {
+		t.Fatalf("%v", err)
+	}
+	if m.FailedRules() != 1 {
+		t.Error(m.FailedRules())
+	}
+
+	// 另一条规则一条一条加的时候是成功的
+	if !r.called("iptables -A MONCLIENT-IN -p tcp -m tcp --dport 8080 -m comment --comment pid=1234;type=server") {
+		t.Errorf("%v", r.calls)
+	}
+}
+
+func TestIPTablesDuplicatedRule(t *testing.T) {
+	r := newFakeRunner()
+	// 同样的规则被加了两次，计数不一样
+	dup := `[5:500] -A MONCLIENT-IN -p tcp -m tcp --dport 8080 -m comment --comment "pid=1234;type=server"`
+	r.outputs["iptables-save -c -t filter"] = strings.Replace(iptablesSave, "[10:1000] -A MONCLIENT-IN", dup+"\n[10:1000] -A MONCLIENT-IN", 1)
+
+	inputs := []*InputItem{{Family: IPv4, Protocol: TCP, PID: 1234, Port: 8080}}
+	err := NewIPTables(r).Snap(inputs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 留的是最后一条，-D 删掉的是前面多余的那条
+	if inputs[0].InBytes != 1000 || inputs[0].InPackets != 10 {
+		t.Errorf("%v", inputs[0])
+	}
+	var script string
+	for i, c := range r.calls {
+		if c == "iptables-restore --noflush" {
+			script = r.stdins[i]
+		}
+	}
+	if strings.Count(script, "-D MONCLIENT-IN -p tcp -m tcp --dport 8080 ") != 1 {
+		t.Errorf("%q", script)
+	}
+}
+
+func TestIPTablesFamilyFailed(t *testing.T) {
+	r := newFakeRunner()
+	r.outputs["iptables-save -c -t filter"] = iptablesSave
+	// 没有ip6tables
+	r.errors["ip6tables -n -L MONCLIENT-IN"] = errFake
+	r.errors["ip6tables -N MONCLIENT-IN"] = errFake
+
+	m := NewTrafficMonitorWithBackend(NewIPTables(r))
+	snap := func() error {
+		m.ClearAll()
+		m.AddInput(IPv4, TCP, 1234, 42, 8080)
+		m.AddInput(IPv6, TCP, 1234, 42, 8080)
+		return m.Snap()
+	}
+
+	err := snap()
+	re, ok := err.(*RuleError)
+	if !ok || len(re.Skipped) != 1 || re.Skipped[0] != IPv6 {
+		t.Fatalf("%v", err)
+	}
+	if in, _ := m.FindInputTraffics(IPv4, TCP, 1234, 8080); in != (Traffic{1000, 10}) {
+		t.Errorf("%v", in)
+	}
+
+	// ipv4的计数照常增加
+	r.outputs["iptables-save -c -t filter"] = strings.Replace(iptablesSave, "[10:1000]", "[15:1500]", 1)
+	snap()
+	if in, _ := m.FindInputTraffics(IPv4, TCP, 1234, 8080); in != (Traffic{1500, 15}) {
+		t.Errorf("%v", in)
+	}
+
+	// 两个都失败算整个失败
+	r.errors["iptables -n -L MONCLIENT-IN"] = errFake
+	r.errors["iptables -N MONCLIENT-IN"] = errFake
+	if _, ok := snap().(*RuleError); ok {
+		t.Error("should fail entirely")
+	}
+	if in, _ := m.FindInputTraffics(IPv4, TCP, 1234, 8080); in != (Traffic{1500, 15}) {
+		t.Errorf("%v", in)
+	}
+}
+
+func TestIPTablesSnapCgroups(t *testing.T) {
+	r := newFakeRunner()
+	r.outputs["iptables-save -c -t filter"] = iptablesSave +
+		"*filter\n[7:700] -A MONCLIENT-OUT -m cgroup --path /system.slice/game-logic.service -m comment --comment \"type=cgroup\"\nCOMMIT\n"
+
+	b := NewIPTables(r)
+	if !b.SupportsCgroups() {
+		t.Fatal("should support cgroups")
+	}
+	if !r.called("iptables -D MONCLIENT-OUT -m cgroup --path / -m comment --comment type=probe") {
+		t.Errorf("%v", r.calls)
+	}
+
+	m := NewTrafficMonitorWithBackend(b)
+	for _, family := range Families {
+		m.AddCgroup(family, "/system.slice/game-logic.service")
+	}
+	if err := m.Snap(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.FindCgroupOutput(IPv4, "/system.slice/game-logic.service"); got != (Traffic{700, 7}) {
+		t.Errorf("%v", got)
+	}
+
+	// ipv6里还没有，要创建
+	var script string
+	for i, c := range r.calls {
+		if c == "ip6tables-restore --noflush" {
+			script = r.stdins[i]
+		}
+	}
+	want := "*filter\n-A MONCLIENT-OUT -m cgroup --path /system.slice/game-logic.service -m comment --comment \"type=cgroup\"\nCOMMIT\n"
+	if script != want {
+		t.Errorf("%q", script)
+	}
+}
+
+func TestIPTablesCgroupsUnsupported(t *testing.T) {
+	r := newFakeRunner()
+	r.errors["iptables -A MONCLIENT-OUT -m cgroup --path / -m comment --comment type=probe"] = errFake
+
+	b := NewIPTables(r)
+	m := NewTrafficMonitorWithBackend(b)
+	if m.SupportsCgroups() || m.SupportsCgroups() {
+		t.Error("should not support cgroups")
+	}
+
+	// 只检查一次
+	n := 0
+	for _, c := range r.calls {
+		if c == "iptables -A MONCLIENT-OUT -m cgroup --path / -m comment --comment type=probe" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("%v", r.calls)
+	}
+}
+
+func TestParseSaveLine(t *testing.T) {
+	r := parseSaveLine(`[5:500] -A MONCLIENT-OUT -d 2001:db8::1/128 -p udp -m udp --dport 3478 -m comment --comment "pid=42;type=client"`)
+	want := ruleKey{chain: chainOut, kind: "client", protocol: UDP, pid: 42, port: 3478, address: "2001:db8::1"}
+	if r == nil || r.key != want || r.bytes != 500 || r.packets != 5 {
+		t.Errorf("%v", r)
+	}
+
+	// 汇总的对外连接：只按端口，或者只按网段
+	r = parseSaveLine(`[2:200] -A MONCLIENT-OUT -p tcp -m tcp --dport 3306 -m comment --comment "pid=42;type=client"`)
+	want = ruleKey{chain: chainOut, kind: "client", protocol: TCP, pid: 42, port: 3306}
+	if r == nil || r.key != want {
+		t.Errorf("%v", r)
+	}
+	r = parseSaveLine(`[2:200] -A MONCLIENT-OUT -d 10.1.0.0/16 -p tcp -m comment --comment "pid=42;type=client"`)
+	want = ruleKey{chain: chainOut, kind: "client", protocol: TCP, pid: 42, address: "10.1.0.0/16"}
+	if r == nil || r.key != want {
+		t.Errorf("%v", r)
+	}
+
+	// 按远端地址统计的监听端口
+	r = parseSaveLine(`[3:300] -A MONCLIENT-IN -s 10.0.0.1/32 -p tcp -m tcp --dport 8080 -m comment --comment "pid=42;type=peer"`)
+	want = ruleKey{chain: chainIn, kind: "peer", protocol: TCP, pid: 42, port: 8080, address: "10.0.0.1"}
+	if r == nil || r.key != want || r.bytes != 300 {
+		t.Errorf("%v", r)
+	}
+
+	if parseSaveLine("[1:1] -A INPUT -j MONCLIENT-IN") != nil {
+		t.Error("should ignore other chains")
+	}
+}
+
+func TestIPTablesAggregatedClients(t *testing.T) {
+	clients := []*ClientConnection{
+		{Family: IPv4, Protocol: TCP, PID: 42, Port: 3306},
+		{Family: IPv4, Protocol: UDP, PID: 42, Address: "10.1.0.0/16"},
+	}
+
+	specs := []string{}
+	for _, w := range iptablesWantedRules(IPv4, nil, clients, nil) {
+		specs = append(specs, w.spec)
+	}
+	want := []string{
+		`MONCLIENT-OUT -p tcp -m tcp --dport 3306 -m comment --comment "pid=42;type=client"`,
+		`MONCLIENT-OUT -d 10.1.0.0/16 -p udp -m comment --comment "pid=42;type=client"`,
+	}
+	if len(specs) != len(want) {
+		t.Fatalf("%v", specs)
+	}
+	for i := range want {
+		if specs[i] != want[i] {
+			t.Errorf("want %s, got %s", want[i], specs[i])
+		}
+	}
+}
+
+func TestIPTablesPeerInputs(t *testing.T) {
+	inputs := []*InputItem{
+		{Family: IPv4, Protocol: TCP, PID: 42, Port: 8080, Peer: "10.0.0.1"},
+		{Family: IPv6, Protocol: TCP, PID: 42, Port: 8080, Peer: "2001:db8::1"},
+	}
+
+	ws := iptablesWantedRules(IPv4, inputs, nil, nil)
+	want := `MONCLIENT-IN -s 10.0.0.1 -p tcp -m tcp --dport 8080 -m comment --comment "pid=42;type=peer"`
+	if len(ws) != 1 || ws[0].spec != want {
+		t.Fatalf("%v", ws)
+	}
+
+	// 规则的身份要和iptables-save读回来的一样，不然每次都会删了重建
+	r := parseSaveLine("[1:100] -A " + `MONCLIENT-IN -s 10.0.0.1/32 -p tcp -m tcp --dport 8080 -m comment --comment "pid=42;type=peer"`)
+	if r == nil || r.key != ws[0].key {
+		t.Errorf("%v %v", r, ws[0].key)
+	}
+}
+
+func TestIPTablesClose(t *testing.T) {
+	r := newFakeRunner()
+	// ipv4的OUTPUT里跳转被加了两次，ipv6的链不存在
+	r.errorSeqs["iptables -C INPUT -j MONCLIENT-IN"] = []error{nil}
+	r.errorSeqs["iptables -C OUTPUT -j MONCLIENT-OUT"] = []error{nil, nil}
+	r.errors["iptables -C INPUT -j MONCLIENT-IN"] = errFake
+	r.errors["iptables -C OUTPUT -j MONCLIENT-OUT"] = errFake
+	r.errors["ip6tables -n -L MONCLIENT-IN"] = errFake
+	r.errors["ip6tables -n -L MONCLIENT-OUT"] = errFake
+
+	err := NewIPTables(r).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"iptables -n -L MONCLIENT-IN",
+		"iptables -C INPUT -j MONCLIENT-IN",
+		"iptables -D INPUT -j MONCLIENT-IN",
+		"iptables -C INPUT -j MONCLIENT-IN",
+		"iptables -F MONCLIENT-IN",
+		"iptables -X MONCLIENT-IN",
+		"iptables -n -L MONCLIENT-OUT",
+		"iptables -C OUTPUT -j MONCLIENT-OUT",
+		"iptables -D OUTPUT -j MONCLIENT-OUT",
+		"iptables -C OUTPUT -j MONCLIENT-OUT",
+		"iptables -D OUTPUT -j MONCLIENT-OUT",
+		"iptables -C OUTPUT -j MONCLIENT-OUT",
+		"iptables -F MONCLIENT-OUT",
+		"iptables -X MONCLIENT-OUT",
+		"ip6tables -n -L MONCLIENT-IN",
+		"ip6tables -n -L MONCLIENT-OUT",
+	}
+	if len(r.calls) != len(want) {
+		t.Fatalf("%v", r.calls)
+	}
+	for i := range want {
+		if r.calls[i] != want[i] {
+			t.Errorf("%d: want %s, got %s", i, want[i], r.calls[i])
+		}
+	}
+}
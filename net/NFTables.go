@@ -0,0 +1,261 @@
+package net
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// nftables里我们自己的表和链。inet表同时处理ipv4和ipv6
+const (
+	nftFamily      = "inet"
+	nftTable       = "monclient"
+	nftInputChain  = "input"
+	nftOutputChain = "output"
+)
+
+// NFTables 用nftables统计流量。所有规则都放在单独的 inet monclient 表里，
+// 每条规则对应一个命名counter，counter和规则的comment都用同一个名字，
+// 这样读回来的时候就知道是哪个进程的哪个端口
+type NFTables struct {
+	runner Runner
+}
+
+// NewNFTables 创建一个NFTables
+func NewNFTables(r Runner) *NFTables {
+	return &NFTables{runner: r}
+}
+
+// nft -j list table 的输出，只关心counter和rule
+type nftListOutput struct {
+	Nftables []struct {
+		Counter *nftCounter `json:"counter"`
+		Rule    *nftRule    `json:"rule"`
+	} `json:"nftables"`
+}
+
+type nftCounter struct {
+	Name    string `json:"name"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+type nftRule struct {
+	Chain   string `json:"chain"`
+	Handle  int    `json:"handle"`
+	Comment string `json:"comment"`
+}
+
+// 一条需要存在的规则
+type nftWanted struct {
+	chain string
+	// counter的名字，同时也是规则的comment
+	name string
+	// 匹配条件
+	match string
+	// 统计到的字节数和包数写到这里
+	bytes   *uint64
+	packets *uint64
+}
+
+// Snap 读出表里已有的counter和规则，和需要的做比较，然后用一个事务把差异应用上去
+func (b *NFTables) Snap(inputs []*InputItem, clients []*ClientConnection) error {
+	counters, rules, err := b.list()
+	if err != nil {
+		return err
+	}
+
+	wanted := nftWantedRules(inputs, clients)
+
+	script := bytes.Buffer{}
+	wantedNames := make(map[string]bool)
+
+	for _, w := range wanted {
+		wantedNames[w.name] = true
+
+		c, hasCounter := counters[w.name]
+		_, hasRule := rules[w.name]
+		if hasCounter && hasRule {
+			*w.bytes = c.Bytes
+			*w.packets = c.Packets
+			continue
+		}
+
+		log.Printf("create nft rule in %s: %s", w.chain, w.name)
+		if !hasCounter {
+			fmt.Fprintf(&script, "add counter %s %s %s\n", nftFamily, nftTable, w.name)
+		}
+		if !hasRule {
+			fmt.Fprintf(&script, "add rule %s %s %s %s counter name %s comment \"%s\"\n", nftFamily, nftTable, w.chain, w.match, w.name, w.name)
+		}
+	}
+
+	// 先删规则再删counter，counter被规则引用时是删不掉的
+	for name, r := range rules {
+		if !wantedNames[name] {
+			log.Printf("remove unwanted nft rule: %s", name)
+			fmt.Fprintf(&script, "delete rule %s %s %s handle %d\n", nftFamily, nftTable, r.Chain, r.Handle)
+		}
+	}
+	for name := range counters {
+		if !wantedNames[name] {
+			fmt.Fprintf(&script, "delete counter %s %s %s\n", nftFamily, nftTable, name)
+		}
+	}
+
+	if script.Len() == 0 {
+		return nil
+	}
+
+	_, err = b.runner.Run(nftHeader()+script.String(), "nft", "-f", "-")
+	if err == nil {
+		return nil
+	}
+
+	// 一个事务里有一条失败整个都不会生效，再一条一条试，把失败的报出来
+	log.Printf("apply nft script failed, try one by one: %s\n", err)
+
+	failures := []error{}
+	for _, line := range strings.Split(strings.TrimSpace(script.String()), "\n") {
+		if _, err := b.runner.Run(nftHeader()+line+"\n", "nft", "-f", "-"); err != nil {
+			failures = append(failures, err)
+		}
+	}
+
+	if len(failures) > 0 {
+		return &RuleError{Failures: failures}
+	}
+
+	return nil
+}
+
+// Close 直接删掉整个表
+func (b *NFTables) Close() error {
+	_, err := b.runner.Run("", "nft", "delete", "table", nftFamily, nftTable)
+	return err
+}
+
+// list 读出表里所有的counter和带comment的规则，都按名字索引。表不存在时返回空的，
+// 别的错误（没有nft、没权限）直接返回，不然每次都会试着加所有规则，报一堆失败
+func (b *NFTables) list() (map[string]*nftCounter, map[string]*nftRule, error) {
+	counters := make(map[string]*nftCounter)
+	rules := make(map[string]*nftRule)
+
+	out, err := b.runner.Run("", "nft", "-j", "list", "table", nftFamily, nftTable)
+	if err != nil {
+		if !nftNoTable(err) {
+			return nil, nil, err
+		}
+		// 第一次运行时表还没建，Snap里会创建
+		log.Printf("nft table %s %s does not exist, treat as empty\n", nftFamily, nftTable)
+		return counters, rules, nil
+	}
+
+	var o nftListOutput
+	err = json.Unmarshal([]byte(out), &o)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode nft output failed: %s", err)
+	}
+
+	for _, item := range o.Nftables {
+		if item.Counter != nil {
+			counters[item.Counter.Name] = item.Counter
+		}
+		if item.Rule != nil && item.Rule.Comment != "" {
+			rules[item.Rule.Comment] = item.Rule
+		}
+	}
+
+	return counters, rules, nil
+}
+
+// nftNoTable 是不是表不存在。nft这时在stderr里报 Error: No such file or directory
+func nftNoTable(err error) bool {
+	return strings.Contains(err.Error(), "No such file or directory")
+}
+
+// nftHeader 保证表和链存在。add对已经存在的表和链不会报错
+func nftHeader() string {
+	return fmt.Sprintf("add table %[1]s %[2]s\n"+
+		"add chain %[1]s %[2]s %[3]s { type filter hook input priority 0; policy accept; }\n"+
+		"add chain %[1]s %[2]s %[4]s { type filter hook output priority 0; policy accept; }\n",
+		nftFamily, nftTable, nftInputChain, nftOutputChain)
+}
+
+// nftWantedRules 把需要统计的端口和连接转成规则。监听端口进出各一条，监听端口的每个远端地址只统计进来的，
+// 对外连接只统计发出的
+func nftWantedRules(inputs []*InputItem, clients []*ClientConnection) []*nftWanted {
+	rez := []*nftWanted{}
+
+	for _, item := range inputs {
+		if item.Peer != "" {
+			addrMatch := "ip saddr"
+			if item.Family == IPv6 {
+				addrMatch = "ip6 saddr"
+			}
+
+			rez = append(rez, &nftWanted{
+				chain:   nftInputChain,
+				name:    nftName("peer", item.Family, item.Protocol, item.PID, item.Port, item.Peer),
+				match:   fmt.Sprintf("%s %s %s dport %d", addrMatch, item.Peer, item.Protocol, item.Port),
+				bytes:   &item.InBytes,
+				packets: &item.InPackets,
+			})
+			continue
+		}
+
+		rez = append(rez, &nftWanted{
+			chain:   nftInputChain,
+			name:    nftName("in", item.Family, item.Protocol, item.PID, item.Port),
+			match:   fmt.Sprintf("meta nfproto %s %s dport %d", item.Family, item.Protocol, item.Port),
+			bytes:   &item.InBytes,
+			packets: &item.InPackets,
+		}, &nftWanted{
+			chain:   nftOutputChain,
+			name:    nftName("out", item.Family, item.Protocol, item.PID, item.Port),
+			match:   fmt.Sprintf("meta nfproto %s %s sport %d", item.Family, item.Protocol, item.Port),
+			bytes:   &item.OutBytes,
+			packets: &item.OutPackets,
+		})
+	}
+
+	for _, item := range clients {
+		// 汇总的连接可能没有地址（只按端口）或者没有端口（按服务的网段）
+		match := fmt.Sprintf("meta nfproto %s", item.Family)
+		if item.Address != "" {
+			if item.Family == IPv6 {
+				match = "ip6 daddr " + item.Address
+			} else {
+				match = "ip daddr " + item.Address
+			}
+		}
+		if item.Port != 0 {
+			match += fmt.Sprintf(" %s dport %d", item.Protocol, item.Port)
+		} else {
+			match += fmt.Sprintf(" meta l4proto %s", item.Protocol)
+		}
+
+		rez = append(rez, &nftWanted{
+			chain:   nftOutputChain,
+			name:    nftName("client", item.Family, item.Protocol, item.PID, item.Port, item.Address),
+			match:   match,
+			bytes:   &item.Bytes,
+			packets: &item.Packets,
+		})
+	}
+
+	return rez
+}
+
+// nftName 生成counter的名字，比如 in_ipv4_tcp_1234_8080、client_ipv6_tcp_1234_443_2001_db8__1。
+// nft的名字里不能有 . 和 :，网段里的 / 也一起换成 _
+func nftName(kind string, parts ...interface{}) string {
+	ss := []string{kind}
+	for _, p := range parts {
+		ss = append(ss, fmt.Sprint(p))
+	}
+
+	return strings.NewReplacer(".", "_", ":", "_", "/", "_").Replace(strings.Join(ss, "_"))
+}
@@ -0,0 +1,159 @@
+package net
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const nftList = "nft -j list table inet monclient"
+
+func TestNFTablesCreate(t *testing.T) {
+	r := newFakeRunner()
+	r.errors[nftList] = errors.New("No such file or directory")
+	b := NewNFTables(r)
+
+	inputs := []*InputItem{{Family: IPv4, Protocol: TCP, PID: 1234, Port: 8080}}
+	clients := []*ClientConnection{{Family: IPv6, Protocol: UDP, PID: 1234, Address: "2001:db8::1", Port: 3478}}
+
+	err := b.Snap(inputs, clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.calls) != 2 || r.calls[1] != "nft -f -" {
+		t.Fatalf("%v", r.calls)
+	}
+
+	script := r.stdins[1]
+	for _, want := range []string{
+		"add table inet monclient\n",
+		"add chain inet monclient input { type filter hook input priority 0; policy accept; }\n",
+		"add counter inet monclient in_ipv4_tcp_1234_8080\n",
+		"add rule inet monclient input meta nfproto ipv4 tcp dport 8080 counter name in_ipv4_tcp_1234_8080 comment \"in_ipv4_tcp_1234_8080\"\n",
+		"add rule inet monclient output meta nfproto ipv4 tcp sport 8080 counter name out_ipv4_tcp_1234_8080 comment \"out_ipv4_tcp_1234_8080\"\n",
+		"add rule inet monclient output ip6 daddr 2001:db8::1 udp dport 3478 counter name client_ipv6_udp_1234_3478_2001_db8__1 comment \"client_ipv6_udp_1234_3478_2001_db8__1\"\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("missing %q in:\n%s", want, script)
+		}
+	}
+}
+
+func TestNFTablesListFailed(t *testing.T) {
+	r := newFakeRunner()
+	r.errors[nftList] = errors.New("nft -j list table inet monclient: exit status 1: Error: Could not process rule: Operation not permitted")
+
+	inputs := []*InputItem{{Family: IPv4, Protocol: TCP, PID: 1234, Port: 8080}}
+	err := NewNFTables(r).Snap(inputs, nil)
+	if err == nil {
+		t.Fatal("should fail")
+	}
+	if _, ok := err.(*RuleError); ok || len(r.calls) != 1 {
+		t.Errorf("%v %v", err, r.calls)
+	}
+}
+
+func TestNFTablesReadAndCleanup(t *testing.T) {
+	r := newFakeRunner()
+	r.outputs[nftList] = `{"nftables": [
+		{"metainfo": {"version": "1.0.2", "release_name": "Lester Gooch", "json_schema_version": 1}},
+		{"table": {"family": "inet", "name": "monclient", "handle": 7}},
+		{"chain": {"family": "inet", "table": "monclient", "name": "input", "handle": 1, "type": "filter", "hook": "input", "prio": 0, "policy": "accept"}},
+		{"chain": {"family": "inet", "table": "monclient", "name": "output", "handle": 2, "type": "filter", "hook": "output", "prio": 0, "policy": "accept"}},
+		{"counter": {"family": "inet", "name": "in_ipv4_tcp_1234_8080", "table": "monclient", "handle": 3, "packets": 10, "bytes": 1000}},
+		{"counter": {"family": "inet", "name": "out_ipv4_tcp_1234_8080", "table": "monclient", "handle": 4, "packets": 20, "bytes": 2000}},
+		{"counter": {"family": "inet", "name": "in_ipv4_tcp_999_80", "table": "monclient", "handle": 5, "packets": 1, "bytes": 1}},
+		{"rule": {"family": "inet", "table": "monclient", "chain": "input", "handle": 8, "comment": "in_ipv4_tcp_1234_8080", "expr": []}},
+		{"rule": {"family": "inet", "table": "monclient", "chain": "output", "handle": 9, "comment": "out_ipv4_tcp_1234_8080", "expr": []}},
+		{"rule": {"family": "inet", "table": "monclient", "chain": "input", "handle": 10, "comment": "in_ipv4_tcp_999_80", "expr": []}}
+	]}`
+	b := NewNFTables(r)
+
+	inputs := []*InputItem{{Family: IPv4, Protocol: TCP, PID: 1234, Port: 8080}}
+	err := b.Snap(inputs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inputs[0].InBytes != 1000 || inputs[0].OutBytes != 2000 || inputs[0].OutPackets != 20 {
+		t.Errorf("%v", inputs[0])
+	}
+
+	if len(r.calls) != 2 {
+		t.Fatalf("%v", r.calls)
+	}
+	script := r.stdins[1]
+	if strings.Contains(script, "add counter") || strings.Contains(script, "add rule") {
+		t.Errorf("nothing should be added:\n%s", script)
+	}
+	if !strings.Contains(script, "delete rule inet monclient input handle 10\n") || !strings.Contains(script, "delete counter inet monclient in_ipv4_tcp_999_80\n") {
+		t.Errorf("stale rule not removed:\n%s", script)
+	}
+	if strings.Index(script, "delete rule") > strings.Index(script, "delete counter") {
+		t.Errorf("rule must be deleted before counter:\n%s", script)
+	}
+}
+
+func TestNFTablesNoChange(t *testing.T) {
+	r := newFakeRunner()
+	r.outputs[nftList] = `{"nftables": [
+		{"counter": {"name": "client_ipv4_tcp_1_3306_10_0_0_9", "packets": 3, "bytes": 300}},
+		{"rule": {"chain": "output", "handle": 4, "comment": "client_ipv4_tcp_1_3306_10_0_0_9"}}
+	]}`
+	b := NewNFTables(r)
+
+	clients := []*ClientConnection{{Family: IPv4, Protocol: TCP, PID: 1, Address: "10.0.0.9", Port: 3306}}
+	err := b.Snap(nil, clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if clients[0].Bytes != 300 {
+		t.Errorf("%v", clients[0])
+	}
+	// 没有变化就不用执行nft -f
+	if len(r.calls) != 1 {
+		t.Errorf("%v", r.calls)
+	}
+}
+
+func TestNFTablesClose(t *testing.T) {
+	r := newFakeRunner()
+	m := NewTrafficMonitorWithBackend(NewNFTables(r))
+
+	err := m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.calls) != 1 || r.calls[0] != "nft delete table inet monclient" {
+		t.Errorf("%v", r.calls)
+	}
+
+	if m.Snap() == nil {
+		t.Error("snap after close should fail")
+	}
+}
+
+func TestNFTablesFallback(t *testing.T) {
+	r := newFakeRunner()
+	r.errors[nftList] = errors.New("No such file or directory")
+	// 整个事务失败，一条一条来的时候第二条失败
+	r.errorSeqs["nft -f -"] = []error{errFake, nil, errFake}
+
+	inputs := []*InputItem{{Family: IPv4, Protocol: TCP, PID: 1234, Port: 8080}}
+	err := NewNFTables(r).Snap(inputs, nil)
+
+	re, ok := err.(*RuleError)
+	if !ok || len(re.Failures) != 1 {
+		t.Fatalf("%v", err)
+	}
+
+	// 1次事务 + 4条规则
+	if len(r.calls) != 6 {
+		t.Fatalf("%v", r.calls)
+	}
+	if !strings.HasSuffix(r.stdins[3], "add rule inet monclient input meta nfproto ipv4 tcp dport 8080 counter name in_ipv4_tcp_1234_8080 comment \"in_ipv4_tcp_1234_8080\"\n") {
+		t.Errorf("%q", r.stdins[3])
+	}
+}
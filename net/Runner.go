@@ -0,0 +1,36 @@
+package net
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Runner 执行外部命令。测试时可以换成假的，这样不需要root也不会真的改规则
+type Runner interface {
+	// Run 执行命令并返回stdout。stdin不为空时会作为命令的输入
+	Run(stdin string, name string, args ...string) (string, error)
+}
+
+// ExecRunner 真正执行命令的Runner
+type ExecRunner struct{}
+
+// Run 执行命令。出错时把stderr带到error里，方便看日志
+func (ExecRunner) Run(stdin string, name string, args ...string) (string, error) {
+	c := exec.Command(name, args...)
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if stdin != "" {
+		c.Stdin = strings.NewReader(stdin)
+	}
+
+	err := c.Run()
+	if err != nil {
+		return stdout.String(), fmt.Errorf("%s %s: %s: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,45 @@
+package net
+
+import (
+	"strings"
+)
+
+// fakeRunner 记录所有执行过的命令，按命令行返回预先准备好的输出
+type fakeRunner struct {
+	// key 是空格连接的完整命令行
+	outputs map[string]string
+	errors  map[string]error
+	// 按顺序返回的错误，用完了才看errors
+	errorSeqs map[string][]error
+	calls     []string
+	stdins    []string
+}
+
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{
+		outputs:   make(map[string]string),
+		errors:    make(map[string]error),
+		errorSeqs: make(map[string][]error),
+	}
+}
+
+func (r *fakeRunner) Run(stdin string, name string, args ...string) (string, error) {
+	cmd := strings.Join(append([]string{name}, args...), " ")
+	r.calls = append(r.calls, cmd)
+	r.stdins = append(r.stdins, stdin)
+	if seq := r.errorSeqs[cmd]; len(seq) > 0 {
+		r.errorSeqs[cmd] = seq[1:]
+		return r.outputs[cmd], seq[0]
+	}
+	return r.outputs[cmd], r.errors[cmd]
+}
+
+// called 判断是否执行过某个命令
+func (r *fakeRunner) called(cmd string) bool {
+	for _, c := range r.calls {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
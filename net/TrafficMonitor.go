@@ -0,0 +1,384 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Family 地址族。ipv4的规则加在iptables里，ipv6的加在ip6tables里
+type Family string
+
+const (
+	IPv4 Family = "ipv4"
+	IPv6 Family = "ipv6"
+)
+
+// Families 所有支持的地址族
+var Families = []Family{IPv4, IPv6}
+
+// Protocol 传输层协议
+type Protocol string
+
+const (
+	TCP Protocol = "tcp"
+	UDP Protocol = "udp"
+)
+
+// Backend 是真正统计流量的实现，比如iptables或者nftables
+type Backend interface {
+	// Snap 让系统里的规则和inputs、clients一致：删掉不需要的，创建缺少的，
+	// 并把已有规则统计到的字节数填到对应的item里
+	Snap(inputs []*InputItem, clients []*ClientConnection) error
+	// Close 删除所有由这个Backend创建的规则
+	Close() error
+}
+
+// CgroupBackend 还能按cgroup统计发出流量的Backend。
+// 不用跟着一个个连接加规则，连接再短也能统计到
+type CgroupBackend interface {
+	Backend
+	// SupportsCgroups 系统是否支持按cgroup统计
+	SupportsCgroups() bool
+	// SnapWithCgroups 同Snap，另外还有按cgroup统计的规则
+	SnapWithCgroups(inputs []*InputItem, clients []*ClientConnection, cgroups []*CgroupItem) error
+}
+
+// NewBackend 根据名字创建Backend。支持 iptables 和 nftables
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case "iptables":
+		return NewIPTables(ExecRunner{}), nil
+	case "nftables":
+		return NewNFTables(ExecRunner{}), nil
+	default:
+		return nil, fmt.Errorf("unknown traffic backend: %s", name)
+	}
+}
+
+var errTrafficMonitorClosed = errors.New("traffic monitor is closed")
+
+// RuleError 表示有一部分规则没能创建或删除。其它规则不受影响，计数也是正常的
+type RuleError struct {
+	Failures []error
+	// 这些地址族的计数整个没读到，累计值保持不变
+	Skipped []Family
+}
+
+func (e *RuleError) Error() string {
+	ss := []string{}
+	for _, f := range e.Failures {
+		ss = append(ss, f.Error())
+	}
+	return fmt.Sprintf("%d rules failed: %s", len(e.Failures), strings.Join(ss, "; "))
+}
+
+// TrafficMonitor is tool for TrafficMonitor
+type TrafficMonitor struct {
+	inputs            []*InputItem
+	clientConnections []*ClientConnection
+	cgroups           []*CgroupItem
+
+	backend Backend
+	// 保护backend，Close可能和Snap在不同的goroutine里调用
+	mu     sync.Mutex
+	closed bool
+	// 累计失败的规则数
+	failedRules uint64
+	// 每条规则的基准值和累计值。规则被重建、计数被清零都不会让累计值变小
+	counters map[counterKey]*counterState
+}
+
+// Traffic 流量计数
+type Traffic struct {
+	Bytes   uint64
+	Packets uint64
+}
+
+// advance 根据规则上一次和这一次的原始计数累加。原始计数变小说明规则被重建或者清零了，
+// 这时这次的原始计数就是清零以后的增量
+func (t Traffic) advance(last Traffic, raw Traffic) Traffic {
+	if raw.Bytes >= last.Bytes {
+		t.Bytes += raw.Bytes - last.Bytes
+	} else {
+		t.Bytes += raw.Bytes
+	}
+
+	if raw.Packets >= last.Packets {
+		t.Packets += raw.Packets - last.Packets
+	} else {
+		t.Packets += raw.Packets
+	}
+
+	return t
+}
+
+// 一条规则计数的身份，不含进程启动时间
+type counterKey struct {
+	// in、out、peer、client 或 cgroup
+	kind     string
+	family   Family
+	protocol Protocol
+	pid      int
+	port     int
+	// 对外连接、peer的远端地址，或者cgroup的路径
+	address string
+}
+
+type counterState struct {
+	startTime uint64
+	// 上一次读到的原始计数
+	last Traffic
+	// 累计值
+	total Traffic
+}
+
+// NewTrafficMonitor 创建一个用iptables统计的TrafficMonitor
+func NewTrafficMonitor() *TrafficMonitor {
+	return NewTrafficMonitorWithBackend(NewIPTables(ExecRunner{}))
+}
+
+// NewTrafficMonitorWithBackend 创建一个用指定Backend统计的TrafficMonitor
+func NewTrafficMonitorWithBackend(b Backend) *TrafficMonitor {
+	return &TrafficMonitor{
+		backend:  b,
+		counters: make(map[counterKey]*counterState),
+	}
+}
+
+// ClearAll 清除当前记录的所有端口信息
+func (t *TrafficMonitor) ClearAll() {
+	t.inputs = nil
+	t.clientConnections = nil
+	t.cgroups = nil
+}
+
+// SupportsCgroups Backend是否支持按cgroup统计。不支持的话只能按端口和连接统计
+func (t *TrafficMonitor) SupportsCgroups() bool {
+	cb, ok := t.backend.(CgroupBackend)
+	return ok && cb.SupportsCgroups()
+}
+
+// AddCgroup 添加一个需要统计发出流量的cgroup，path 是cgroup v2里的路径，比如 /system.slice/nginx.service。
+// 要先确认 SupportsCgroups
+func (t *TrafficMonitor) AddCgroup(family Family, path string) {
+	t.cgroups = append(t.cgroups, &CgroupItem{
+		Family: family,
+		Path:   path,
+	})
+}
+
+// AddInput 添加一个需要统计的监听端口
+// 这个端口会被加到INPUT/OUTPUT chain里。startTime 是进程的启动时间，用来识别pid被复用
+func (t *TrafficMonitor) AddInput(family Family, protocol Protocol, pid int, startTime uint64, port int) {
+	t.inputs = append(t.inputs, &InputItem{
+		Family:    family,
+		Protocol:  protocol,
+		PID:       pid,
+		StartTime: startTime,
+		Port:      port,
+	})
+}
+
+// AddPeerInput 添加一个需要按远端地址统计进来流量的监听端口和远端地址。只统计进来的方向
+func (t *TrafficMonitor) AddPeerInput(family Family, protocol Protocol, pid int, startTime uint64, port int, peer string) {
+	t.inputs = append(t.inputs, &InputItem{
+		Family:    family,
+		Protocol:  protocol,
+		PID:       pid,
+		StartTime: startTime,
+		Port:      port,
+		Peer:      peer,
+	})
+}
+
+// AddClientConnection 添加一个作为客户端连出去的iptables rule
+// port 表示远程目标端口
+func (t *TrafficMonitor) AddClientConnection(family Family, protocol Protocol, pid int, startTime uint64, addr string, port int) {
+	t.clientConnections = append(t.clientConnections, &ClientConnection{
+		Family:    family,
+		Protocol:  protocol,
+		PID:       pid,
+		StartTime: startTime,
+		Address:   addr,
+		Port:      port,
+	})
+}
+
+// InputItem represent a listening socket
+// 字节数和包数是Backend读到的规则上的原始计数
+type InputItem struct {
+	Family     Family
+	Protocol   Protocol
+	PID        int
+	StartTime  uint64
+	Port       int
+	InBytes    uint64
+	OutBytes   uint64
+	InPackets  uint64
+	OutPackets uint64
+	// 不为空时只统计从这个远端地址进来的流量，没有发出的方向
+	Peer string
+}
+
+// ClientConnection 表示作为客户端向外的连接，不包括监听端口对外发包的方向
+type ClientConnection struct {
+	Family    Family
+	Protocol  Protocol
+	PID       int
+	StartTime uint64
+	// 远端的地址，比如ip
+	Address string
+	// 远端目标端口
+	Port int
+	// 发送的字节数和包数
+	Bytes   uint64
+	Packets uint64
+}
+
+// CgroupItem 一个cgroup里所有socket发出的流量
+type CgroupItem struct {
+	Family  Family
+	Path    string
+	Bytes   uint64
+	Packets uint64
+}
+
+// Snap run command one time
+func (t *TrafficMonitor) Snap() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return errTrafficMonitorClosed
+	}
+
+	var err error
+	if cb, ok := t.backend.(CgroupBackend); ok && len(t.cgroups) > 0 {
+		err = cb.SnapWithCgroups(t.inputs, t.clientConnections, t.cgroups)
+	} else {
+		err = t.backend.Snap(t.inputs, t.clientConnections)
+	}
+	re, partial := err.(*RuleError)
+	if partial {
+		t.failedRules += uint64(len(re.Failures))
+	}
+
+	// 整个失败时什么都没读到，不能当成计数清零了
+	if err == nil {
+		t.accumulate(nil)
+	} else if partial {
+		t.accumulate(re.Skipped)
+	}
+
+	return err
+}
+
+// accumulate 用这次读到的原始计数更新累计值。这次没有的规则就不再记录了；
+// skipped 里的地址族这次没读到，原来的累计值照搬
+func (t *TrafficMonitor) accumulate(skipped []Family) {
+	counters := make(map[counterKey]*counterState)
+
+	update := func(key counterKey, startTime uint64, raw Traffic) {
+		for _, f := range skipped {
+			if key.family == f {
+				if s, ok := t.counters[key]; ok {
+					counters[key] = s
+				}
+				return
+			}
+		}
+
+		s, ok := t.counters[key]
+		switch {
+		case !ok:
+			s = &counterState{startTime: startTime, total: raw}
+		case s.startTime != startTime:
+			// pid被复用了，规则上的计数还是上一个进程的，从现在开始重新算
+			s = &counterState{startTime: startTime}
+		default:
+			s.total = s.total.advance(s.last, raw)
+		}
+		s.last = raw
+		counters[key] = s
+	}
+
+	for _, item := range t.inputs {
+		if item.Peer != "" {
+			key := counterKey{kind: "peer", family: item.Family, protocol: item.Protocol, pid: item.PID, port: item.Port, address: item.Peer}
+			update(key, item.StartTime, Traffic{Bytes: item.InBytes, Packets: item.InPackets})
+			continue
+		}
+
+		key := counterKey{kind: "in", family: item.Family, protocol: item.Protocol, pid: item.PID, port: item.Port}
+		update(key, item.StartTime, Traffic{Bytes: item.InBytes, Packets: item.InPackets})
+		key.kind = "out"
+		update(key, item.StartTime, Traffic{Bytes: item.OutBytes, Packets: item.OutPackets})
+	}
+
+	for _, item := range t.clientConnections {
+		key := counterKey{kind: "client", family: item.Family, protocol: item.Protocol, pid: item.PID, port: item.Port, address: item.Address}
+		update(key, item.StartTime, Traffic{Bytes: item.Bytes, Packets: item.Packets})
+	}
+
+	for _, item := range t.cgroups {
+		key := counterKey{kind: "cgroup", family: item.Family, address: item.Path}
+		update(key, 0, Traffic{Bytes: item.Bytes, Packets: item.Packets})
+	}
+
+	t.counters = counters
+}
+
+// total 返回一条规则的累计值
+func (t *TrafficMonitor) total(key counterKey) Traffic {
+	if s, ok := t.counters[key]; ok {
+		return s.total
+	}
+
+	return Traffic{}
+}
+
+// FailedRules 返回累计有多少次规则创建或删除失败
+func (t *TrafficMonitor) FailedRules() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.failedRules
+}
+
+// Close 删除所有创建的规则。之后Snap都会失败
+func (t *TrafficMonitor) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	return t.backend.Close()
+}
+
+// FindInputTraffics 获得一个监听端口的累计流量(in and out)。同一个进程的累计值只增不减
+func (t *TrafficMonitor) FindInputTraffics(family Family, protocol Protocol, pid int, port int) (Traffic, Traffic) {
+	key := counterKey{kind: "in", family: family, protocol: protocol, pid: pid, port: port}
+	in := t.total(key)
+	key.kind = "out"
+	return in, t.total(key)
+}
+
+// FindClientOutput 获得一个对外连接的累计发送流量
+func (t *TrafficMonitor) FindClientOutput(family Family, protocol Protocol, pid int, addr string, port int) Traffic {
+	return t.total(counterKey{kind: "client", family: family, protocol: protocol, pid: pid, port: port, address: addr})
+}
+
+// FindCgroupOutput 获得一个cgroup的累计发送流量
+func (t *TrafficMonitor) FindCgroupOutput(family Family, path string) Traffic {
+	return t.total(counterKey{kind: "cgroup", family: family, address: path})
+}
+
+// FindPeerInput 获得一个监听端口从一个远端地址进来的累计流量
+func (t *TrafficMonitor) FindPeerInput(family Family, protocol Protocol, pid int, port int, peer string) Traffic {
+	return t.total(counterKey{kind: "peer", family: family, protocol: protocol, pid: pid, port: port, address: peer})
+}
@@ -0,0 +1,86 @@
+package net
+
+import (
+	"testing"
+)
+
+// fakeBackend 每次Snap把raw里的计数填到监听端口上
+type fakeBackend struct {
+	raw []Traffic
+	err error
+}
+
+func (b *fakeBackend) Snap(inputs []*InputItem, clients []*ClientConnection) error {
+	if b.err != nil {
+		return b.err
+	}
+
+	t := b.raw[0]
+	b.raw = b.raw[1:]
+	for _, item := range inputs {
+		item.InBytes, item.InPackets = t.Bytes, t.Packets
+	}
+
+	return nil
+}
+
+func (b *fakeBackend) Close() error {
+	return nil
+}
+
+func snapInput(t *testing.T, m *TrafficMonitor, startTime uint64) Traffic {
+	m.ClearAll()
+	m.AddInput(IPv4, TCP, 1234, startTime, 8080)
+	if err := m.Snap(); err != nil {
+		t.Fatal(err)
+	}
+
+	in, _ := m.FindInputTraffics(IPv4, TCP, 1234, 8080)
+	return in
+}
+
+func TestTrafficMonitorCounterReset(t *testing.T) {
+	b := &fakeBackend{raw: []Traffic{{100, 1}, {300, 3}, {50, 1}, {80, 2}}}
+	m := NewTrafficMonitorWithBackend(b)
+
+	// 规则被重建以后计数从50重新开始，累计值继续往上加
+	for _, want := range []Traffic{{100, 1}, {300, 3}, {350, 4}, {380, 5}} {
+		if got := snapInput(t, m, 42); got != want {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestTrafficMonitorPIDReuse(t *testing.T) {
+	b := &fakeBackend{raw: []Traffic{{100, 1}, {300, 3}, {400, 4}}}
+	m := NewTrafficMonitorWithBackend(b)
+
+	snapInput(t, m, 42)
+	// 同一个pid换了个进程，规则上的300是上一个进程的
+	if got := snapInput(t, m, 43); got != (Traffic{}) {
+		t.Errorf("%v", got)
+	}
+	if got := snapInput(t, m, 43); got != (Traffic{100, 1}) {
+		t.Errorf("%v", got)
+	}
+}
+
+func TestTrafficMonitorSnapFailed(t *testing.T) {
+	b := &fakeBackend{raw: []Traffic{{100, 1}, {300, 3}}}
+	m := NewTrafficMonitorWithBackend(b)
+
+	snapInput(t, m, 42)
+
+	// 整个失败时不更新累计值
+	b.err = errFake
+	m.ClearAll()
+	m.AddInput(IPv4, TCP, 1234, 42, 8080)
+	if err := m.Snap(); err == nil {
+		t.Fatal("should fail")
+	}
+
+	b.err = nil
+	if got := snapInput(t, m, 42); got != (Traffic{300, 3}) {
+		t.Errorf("%v", got)
+	}
+}
@@ -0,0 +1,245 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Cgroup 一个systemd unit或容器的cgroup的资源用量。
+// 和按pid采样相比，短命的子进程也算在里面，线程也不会重复计算
+type Cgroup struct {
+	// cgroup路径，比如 /system.slice/nginx.service
+	Path string
+	// 属于哪个组，取这个cgroup里第一个进程的
+	Group       string
+	ContainerID string
+	Unit        string
+
+	// 累计的cpu时间，秒
+	CPU float64
+	// 使用的内存，包括page cache
+	Memory uint64
+	// 进程和线程的数量
+	PIDs uint64
+	// io控制器没打开的话为nil
+	IO *CgroupIO
+}
+
+// CgroupIO cgroup里所有块设备的读写加起来
+type CgroupIO struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+	Reads      uint64
+	Writes     uint64
+}
+
+// CgroupTraffic 一个unit或容器的cgroup里所有socket累计发出的流量，包括两次Snap之间开了又关的连接
+type CgroupTraffic struct {
+	Path        string
+	Group       string
+	ContainerID string
+	Unit        string
+
+	Bytes   uint64
+	Packets uint64
+}
+
+// CgroupReader 从cgroupfs读cgroup的资源用量，cgroup v1、v2都支持。
+// v1 每个控制器单独挂载，root下面是 cpuacct、memory、blkio、pids 这些目录，认为同一个cgroup在每个控制器下的路径都一样；
+// v2 所有控制器在同一个目录里，root下面有 cgroup.controllers
+type CgroupReader struct {
+	root string
+}
+
+// NewCgroupReader 创建一个CgroupReader，root 一般是 /sys/fs/cgroup，测试时可以换成别的目录
+func NewCgroupReader(root string) *CgroupReader {
+	return &CgroupReader{root: root}
+}
+
+func (r *CgroupReader) v2() bool {
+	_, err := os.Stat(filepath.Join(r.root, "cgroup.controllers"))
+	return err == nil
+}
+
+// Read 读一个cgroup的资源用量。cpu、内存、pids读不到算出错，io读不到就不要了
+func (r *CgroupReader) Read(path string) (*Cgroup, error) {
+	if r.v2() {
+		return r.readV2(path)
+	}
+	return r.readV1(path)
+}
+
+func (r *CgroupReader) readV2(path string) (*Cgroup, error) {
+	dir := filepath.Join(r.root, path)
+	cg := &Cgroup{Path: path}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	usec, err := strconv.ParseUint(parseFlatKeyed(data)["usage_usec"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad cpu.stat of %s: %s", path, err)
+	}
+	cg.CPU = float64(usec) / 1e6
+
+	cg.Memory, err = readUint(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return nil, err
+	}
+	cg.PIDs, err = readUint(filepath.Join(dir, "pids.current"))
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "io.stat")); err == nil {
+		cg.IO = parseIOStat(data)
+	}
+
+	return cg, nil
+}
+
+func (r *CgroupReader) readV1(path string) (*Cgroup, error) {
+	cg := &Cgroup{Path: path}
+	file := func(controller string, name string) string {
+		return filepath.Join(r.root, controller, path, name)
+	}
+
+	nsec, err := readUint(file("cpuacct", "cpuacct.usage"))
+	if err != nil {
+		return nil, err
+	}
+	cg.CPU = float64(nsec) / 1e9
+
+	cg.Memory, err = readUint(file("memory", "memory.usage_in_bytes"))
+	if err != nil {
+		return nil, err
+	}
+	cg.PIDs, err = readUint(file("pids", "pids.current"))
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err1 := ioutil.ReadFile(file("blkio", "blkio.throttle.io_service_bytes"))
+	ops, err2 := ioutil.ReadFile(file("blkio", "blkio.throttle.io_serviced"))
+	if err1 == nil && err2 == nil {
+		cg.IO = &CgroupIO{}
+		cg.IO.ReadBytes, cg.IO.WriteBytes = parseBlkio(bytes)
+		cg.IO.Reads, cg.IO.Writes = parseBlkio(ops)
+	}
+
+	return cg, nil
+}
+
+func readUint(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// parseFlatKeyed 解析 cpu.stat 这种每行 key value 的文件
+func parseFlatKeyed(data []byte) map[string]string {
+	rez := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fs := strings.Fields(scanner.Text())
+		if len(fs) == 2 {
+			rez[fs[0]] = fs[1]
+		}
+	}
+
+	return rez
+}
+
+// parseIOStat 解析v2的io.stat，每行一个设备，比如
+// 8:0 rbytes=1024 wbytes=2048 rios=1 wios=2 dbytes=0 dios=0
+func parseIOStat(data []byte) *CgroupIO {
+	io := &CgroupIO{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fs := strings.Fields(scanner.Text())
+		if len(fs) < 1 {
+			continue
+		}
+		for _, f := range fs[1:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			switch kv[0] {
+			case "rbytes":
+				io.ReadBytes += v
+			case "wbytes":
+				io.WriteBytes += v
+			case "rios":
+				io.Reads += v
+			case "wios":
+				io.Writes += v
+			}
+		}
+	}
+
+	return io
+}
+
+// parseBlkio 解析v1的 blkio.throttle.io_service_bytes 和 io_serviced，把每个设备的Read、Write加起来。
+// 每行是 8:0 Read 1024，最后一行是 Total 3072
+func parseBlkio(data []byte) (read uint64, write uint64) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fs := strings.Fields(scanner.Text())
+		if len(fs) != 3 {
+			continue
+		}
+		v, err := strconv.ParseUint(fs[2], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		switch fs[1] {
+		case "Read":
+			read += v
+		case "Write":
+			write += v
+		}
+	}
+
+	return read, write
+}
+
+// cgroupScope 进程所在的unit或容器的cgroup路径。进程可能在它下面的子cgroup里，
+// 比如 /system.slice/nginx.service/worker，这时返回 /system.slice/nginx.service。
+// 不在容器里、不是systemd管的进程返回空
+func cgroupScope(p *Proc) string {
+	if p.ContainerID == "" && p.Unit == "" {
+		return ""
+	}
+
+	parts := strings.Split(p.Cgroup, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if p.ContainerID != "" && strings.Contains(parts[i], p.ContainerID) {
+			return strings.Join(parts[:i+1], "/")
+		}
+	}
+	for i := len(parts) - 1; i >= 0; i-- {
+		if parts[i] == p.Unit {
+			return strings.Join(parts[:i+1], "/")
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,146 @@
+package proc
+
+import (
+	"testing"
+
+	"github.com/wanghengwei/monclient/net"
+)
+
+func TestCgroupReader(t *testing.T) {
+	for _, root := range []string{"testdata/cgroup1", "testdata/cgroup2"} {
+		cg, err := NewCgroupReader(root).Read("/system.slice/game-logic.service")
+		if err != nil {
+			t.Fatalf("%s: %s", root, err)
+		}
+
+		if cg.CPU != 2.5 || cg.Memory != 100*1024*1024 || cg.PIDs != 12 {
+			t.Errorf("%s: %+v", root, cg)
+		}
+		if cg.IO == nil || *cg.IO != (CgroupIO{ReadBytes: 5120, WriteBytes: 8192, Reads: 4, Writes: 2}) {
+			t.Errorf("%s: %+v", root, cg.IO)
+		}
+	}
+
+	if _, err := NewCgroupReader("testdata/cgroup2").Read("/system.slice/gone.service"); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestParseIOStat(t *testing.T) {
+	io := parseIOStat([]byte("8:0 rbytes=1024 wbytes=2048 rios=1 wios=2\n\n  \n8:16 rbytes=1024 rios=1\n"))
+	if *io != (CgroupIO{ReadBytes: 2048, WriteBytes: 2048, Reads: 2, Writes: 2}) {
+		t.Errorf("%+v", io)
+	}
+}
+
+func TestCgroupScope(t *testing.T) {
+	id := "3f2a9c0b7d1e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a"
+	for _, c := range []struct {
+		p    Proc
+		want string
+	}{
+		{Proc{Cgroup: "/system.slice/nginx.service/worker", Unit: "nginx.service"}, "/system.slice/nginx.service"},
+		{Proc{Cgroup: "/system.slice/docker-" + id + ".scope", ContainerID: id, Unit: "docker-" + id + ".scope"}, "/system.slice/docker-" + id + ".scope"},
+		{Proc{Cgroup: "/docker/" + id, ContainerID: id}, "/docker/" + id},
+		{Proc{Cgroup: "/user.slice"}, ""},
+	} {
+		if got := cgroupScope(&c.p); got != c.want {
+			t.Errorf("%s: want %s, got %s", c.p.Cgroup, c.want, got)
+		}
+	}
+}
+
+func TestSnapCgroups(t *testing.T) {
+	logic, _ := NewGroup("logic", []string{`service_box`}, nil, "", "")
+	logic.Descendants = true
+
+	p := NewProcessMonitor()
+	p.SetGroups([]*Group{logic})
+	p.SetCgroupReader(NewCgroupReader("testdata/cgroup2"))
+
+	s := NewProcfsSource("testdata/proc")
+	procs, err := s.Snap(p.matchSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Procs = p.assignGroups(procs)
+	p.readCgroups()
+
+	// service_box 和它的worker在同一个unit里，只读一次
+	cgs := p.Cgroups()
+	if len(cgs) != 1 || cgs[0].Group != "logic" || cgs[0].Unit != "game-logic.service" || cgs[0].PIDs != 12 {
+		t.Errorf("%v", cgs)
+	}
+
+	p.SetCgroupReader(nil)
+	p.readCgroups()
+	if len(p.Cgroups()) != 0 {
+		t.Errorf("%v", p.Cgroups())
+	}
+}
+
+// fakeCgroupBackend 给每个cgroup的规则填上固定的计数，对外连接的规则记下来
+type fakeCgroupBackend struct {
+	supported bool
+	clients   []*net.ClientConnection
+}
+
+func (b *fakeCgroupBackend) Snap(inputs []*net.InputItem, clients []*net.ClientConnection) error {
+	return b.SnapWithCgroups(inputs, clients, nil)
+}
+
+func (b *fakeCgroupBackend) SnapWithCgroups(inputs []*net.InputItem, clients []*net.ClientConnection, cgroups []*net.CgroupItem) error {
+	b.clients = clients
+	for _, item := range cgroups {
+		item.Bytes, item.Packets = 100, 1
+	}
+	return nil
+}
+
+func (b *fakeCgroupBackend) SupportsCgroups() bool {
+	return b.supported
+}
+
+func (b *fakeCgroupBackend) Close() error {
+	return nil
+}
+
+func TestTrafficByCgroup(t *testing.T) {
+	procs := func() []*Proc {
+		conn := func() []*ClientConnection {
+			return []*ClientConnection{{Family: net.IPv4, Protocol: net.TCP, Address: "1.2.3.4", Port: 3306}}
+		}
+		return []*Proc{
+			{PID: 1234, Group: "logic", Cgroup: "/system.slice/game-logic.service", Unit: "game-logic.service", ClientConns: conn()},
+			{PID: 1240, Group: "logic", Cgroup: "/system.slice/game-logic.service", Unit: "game-logic.service", ClientConns: conn()},
+			{PID: 2000, Cgroup: "/user.slice", ClientConns: conn()},
+		}
+	}
+
+	b := &fakeCgroupBackend{supported: true}
+	p := NewProcessMonitor()
+	p.SetTrafficBackend(b)
+	p.SetTrafficByCgroup(true)
+	p.Procs = procs()
+	p.snapByTrafficMonitor()
+
+	// 两个进程在同一个unit里，ipv4、ipv6各一条规则；不在unit里的还是按连接统计
+	traffic := p.CgroupTraffic()
+	if len(traffic) != 1 || traffic[0].Group != "logic" || traffic[0].Bytes != 200 || traffic[0].Packets != 2 {
+		t.Errorf("%v", traffic)
+	}
+	if len(b.clients) != 1 || b.clients[0].PID != 2000 {
+		t.Errorf("%v", b.clients)
+	}
+	if len(p.Procs[0].ClientConns) != 0 || len(p.Procs[2].ClientConns) != 1 {
+		t.Errorf("%v", p.Procs)
+	}
+
+	// 不支持的话都按连接统计
+	b.supported = false
+	p.Procs = procs()
+	p.snapByTrafficMonitor()
+	if len(p.CgroupTraffic()) != 0 || len(b.clients) != 3 {
+		t.Errorf("%v %v", p.CgroupTraffic(), b.clients)
+	}
+}
@@ -0,0 +1,121 @@
+package proc
+
+import (
+	"fmt"
+	stdnet "net"
+
+	"github.com/wanghengwei/monclient/net"
+)
+
+// 对外连接的汇总方式
+const (
+	// 每个远端地址和端口单独统计
+	AggregateByAddress = "address"
+	// 只按远端端口
+	AggregateByPort = "port"
+	// 按远端网段和端口
+	AggregateByCIDR = "cidr"
+	// 按配置的服务网段，所有端口算在一起
+	AggregateByService = "service"
+)
+
+// ClientAggregator 把对外连接汇总起来，减少规则数和导出的序列数
+type ClientAggregator struct {
+	mode       string
+	ipv4Prefix int
+	ipv6Prefix int
+	// 按顺序匹配，地址属于第一个包含它的服务
+	services []clientService
+}
+
+type clientService struct {
+	name     string
+	networks []*stdnet.IPNet
+}
+
+// NewClientAggregator 创建一个ClientAggregator。ipv4Prefix、ipv6Prefix 是按网段汇总时的前缀长度
+func NewClientAggregator(mode string, ipv4Prefix int, ipv6Prefix int) (*ClientAggregator, error) {
+	switch mode {
+	case AggregateByAddress, AggregateByPort, AggregateByCIDR, AggregateByService:
+	default:
+		return nil, fmt.Errorf("unknown aggregate mode: %s", mode)
+	}
+
+	if ipv4Prefix < 0 || ipv4Prefix > 32 || ipv6Prefix < 0 || ipv6Prefix > 128 {
+		return nil, fmt.Errorf("bad prefix length: %d, %d", ipv4Prefix, ipv6Prefix)
+	}
+
+	return &ClientAggregator{mode: mode, ipv4Prefix: ipv4Prefix, ipv6Prefix: ipv6Prefix}, nil
+}
+
+// AddService 添加一个按服务汇总时用的服务和它的网段
+func (a *ClientAggregator) AddService(name string, cidrs ...string) error {
+	s := clientService{name: name}
+	for _, cidr := range cidrs {
+		_, n, err := stdnet.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		s.networks = append(s.networks, n)
+	}
+
+	a.services = append(a.services, s)
+	return nil
+}
+
+// aggregate 一个对外连接算在哪里。addr 是导出时的地址，按服务汇总时是服务名；
+// networks 是要统计的网段，为空表示就是addr；port 为0表示所有端口。
+// 解析不了的地址、不属于任何服务的地址还是单独统计
+func (a *ClientAggregator) aggregate(family net.Family, addr string, port int) (string, []string, int) {
+	if a == nil || a.mode == AggregateByAddress {
+		return addr, nil, port
+	}
+	if a.mode == AggregateByPort {
+		return "", nil, port
+	}
+
+	// ipv6的socket连ipv4地址时，地址是 ::ffff:1.2.3.4 这种，规则在ip6tables里，也单独统计
+	ip := stdnet.ParseIP(addr)
+	if ip == nil || (family == net.IPv6 && ip.To4() != nil) {
+		return addr, nil, port
+	}
+
+	if a.mode == AggregateByCIDR {
+		mask := stdnet.CIDRMask(a.ipv6Prefix, 128)
+		if family == net.IPv4 {
+			if ip = ip.To4(); ip == nil {
+				return addr, nil, port
+			}
+			mask = stdnet.CIDRMask(a.ipv4Prefix, 32)
+		}
+		n := &stdnet.IPNet{IP: ip.Mask(mask), Mask: mask}
+		return n.String(), nil, port
+	}
+
+	for _, s := range a.services {
+		if !containsIP(s.networks, ip) {
+			continue
+		}
+
+		// 只统计同一个地址族的网段
+		networks := []string{}
+		for _, n := range s.networks {
+			if (n.IP.To4() != nil) == (family == net.IPv4) {
+				networks = append(networks, n.String())
+			}
+		}
+		return s.name, networks, 0
+	}
+
+	return addr, nil, port
+}
+
+func containsIP(networks []*stdnet.IPNet, ip stdnet.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
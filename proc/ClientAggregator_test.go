@@ -0,0 +1,67 @@
+package proc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wanghengwei/monclient/net"
+)
+
+func TestClientAggregator(t *testing.T) {
+	type result struct {
+		addr     string
+		networks []string
+		port     int
+	}
+
+	for _, c := range []struct {
+		mode   string
+		family net.Family
+		addr   string
+		want   result
+	}{
+		{AggregateByAddress, net.IPv4, "10.1.2.3", result{"10.1.2.3", nil, 3306}},
+		{AggregateByPort, net.IPv4, "10.1.2.3", result{"", nil, 3306}},
+		{AggregateByCIDR, net.IPv4, "10.1.2.3", result{"10.1.2.0/24", nil, 3306}},
+		{AggregateByCIDR, net.IPv6, "2001:db8:1:2::3", result{"2001:db8:1:2::/64", nil, 3306}},
+		{AggregateByService, net.IPv4, "10.1.2.3", result{"mysql", []string{"10.1.0.0/16", "10.2.0.0/16"}, 0}},
+		{AggregateByService, net.IPv6, "2001:db8::3", result{"mysql", []string{"2001:db8::/32"}, 0}},
+		// 不属于任何服务
+		{AggregateByService, net.IPv4, "192.168.0.1", result{"192.168.0.1", nil, 3306}},
+		// ipv6的socket连ipv4地址
+		{AggregateByService, net.IPv6, "::ffff:10.1.2.3", result{"::ffff:10.1.2.3", nil, 3306}},
+	} {
+		a, err := NewClientAggregator(c.mode, 24, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.AddService("mysql", "10.1.0.0/16", "2001:db8::/32", "10.2.0.0/16"); err != nil {
+			t.Fatal(err)
+		}
+
+		addr, networks, port := a.aggregate(c.family, c.addr, 3306)
+		if got := (result{addr, networks, port}); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %s: want %v, got %v", c.mode, c.addr, c.want, got)
+		}
+	}
+
+	if _, err := NewClientAggregator("host", 24, 64); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestAggregatedClientTraffic(t *testing.T) {
+	b := &fakeCgroupBackend{}
+	p := NewProcessMonitor()
+	p.SetTrafficBackend(b)
+
+	proc := &Proc{PID: 1234}
+	proc.AddClientConnection(net.IPv4, net.TCP, "mysql", 0, "10.1.0.0/16", "10.2.0.0/16")
+	p.Procs = []*Proc{proc}
+	p.snapByTrafficMonitor()
+
+	// 服务的每个网段一条规则
+	if len(b.clients) != 2 || b.clients[0].Address != "10.1.0.0/16" || b.clients[1].Address != "10.2.0.0/16" {
+		t.Errorf("%v", b.clients)
+	}
+}
@@ -0,0 +1,83 @@
+package proc
+
+import (
+	"regexp"
+)
+
+// Group 一组进程，比如同一个服务的所有实例。进程重启以后pid和命令行参数会变，但还在同一个组里
+type Group struct {
+	Name string
+	// 为true时组里进程的子孙进程，不属于别的组的话，也算在这个组里
+	Descendants bool
+	// 为true时读组里进程的smaps，导出PSS和USS。读smaps比较慢，进程多的话要注意
+	Smaps bool
+
+	includes []*regexp.Regexp
+	excludes []*regexp.Regexp
+	// 为空表示不限制
+	user   string
+	cgroup *regexp.Regexp
+}
+
+// NewGroup 创建一个Group。includes/excludes 和 cgroup 都是正则表达式，cgroup 为空表示不限制
+func NewGroup(name string, includes []string, excludes []string, user string, cgroup string) (*Group, error) {
+	g := &Group{
+		Name: name,
+		user: user,
+	}
+
+	var err error
+	g.includes, err = appendPatterns(nil, includes)
+	if err != nil {
+		return nil, err
+	}
+	g.excludes, err = appendPatterns(nil, excludes)
+	if err != nil {
+		return nil, err
+	}
+
+	if cgroup != "" {
+		g.cgroup, err = regexp.Compile(cgroup)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// matchCommand 只看命令行。没写includes的组匹配所有命令行
+func (g *Group) matchCommand(c string) bool {
+	if len(g.includes) > 0 && !matchAny(g.includes, c) {
+		return false
+	}
+
+	return !matchAny(g.excludes, c)
+}
+
+// Match 判断进程是否属于这个组
+func (g *Group) Match(p *Proc) bool {
+	if !g.matchCommand(p.Command) {
+		return false
+	}
+
+	if g.user != "" && g.user != p.User {
+		return false
+	}
+
+	if g.cgroup != nil && !g.cgroup.MatchString(p.Cgroup) {
+		return false
+	}
+
+	return true
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, r := range res {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+
+	return false
+}
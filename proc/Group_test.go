@@ -0,0 +1,207 @@
+package proc
+
+import (
+	"testing"
+)
+
+func TestAssignGroups(t *testing.T) {
+	logic, err := NewGroup("logic", []string{`service_box .*logic\.xml`}, nil, "", `game-logic\.service$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate, err := NewGroup("gate", []string{`service_box`}, []string{`logic`}, "game", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProcessMonitor(`^/sbin/init`)
+	p.SetGroups([]*Group{logic, gate})
+
+	s := NewProcfsSource("testdata/proc")
+	procs, err := s.Snap(p.matchSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	procs = p.assignGroups(procs)
+
+	if len(procs) != 2 {
+		t.Fatalf("%v", procs)
+	}
+	if proc := findProcByPID(procs, 1234); proc == nil || proc.Group != "logic" || proc.Cgroup != "/system.slice/game-logic.service" {
+		t.Errorf("%v", proc)
+	}
+	// init 只是在includes里，不属于任何组
+	if proc := findProcByPID(procs, 1); proc == nil || proc.Group != "" {
+		t.Errorf("%v", proc)
+	}
+}
+
+func TestAssignGroupsDescendants(t *testing.T) {
+	logic, err := NewGroup("logic", []string{`service_box`}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logic.Descendants = true
+
+	p := NewProcessMonitor(`^/sbin/init`)
+	p.SetGroups([]*Group{logic})
+
+	s := NewProcfsSource("testdata/proc")
+	procs, err := s.Snap(p.matchSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	procs = p.assignGroups(procs)
+
+	// worker 是 service_box fork出来的，命令行认不出来，但是算在logic组里
+	worker := findProcByPID(procs, 1240)
+	if worker == nil || worker.Group != "logic" || !worker.Descendant || worker.PPID != 1234 {
+		t.Fatalf("%v", worker)
+	}
+	parent := findProcByPID(procs, 1234)
+	if parent == nil || parent.Descendant || len(parent.Children) != 1 || parent.Children[0] != worker {
+		t.Errorf("%v", parent)
+	}
+	// service_box 的父进程是init，init自己匹配的，所以它的子进程也在树里
+	if init := findProcByPID(procs, 1); init == nil || len(init.Children) != 1 {
+		t.Errorf("%v", init)
+	}
+	if findProcByPID(procs, 2) != nil {
+		t.Error("kthreadd should be skipped")
+	}
+}
+
+func TestAssignGroupsGlobalDescendants(t *testing.T) {
+	p := NewProcessMonitor(`service_box`)
+	p.AddExcludes(`^worker -n 2$`)
+	p.SetDescendants(true)
+
+	s := NewProcfsSource("testdata/proc")
+	procs, err := s.Snap(p.matchSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	procs = p.assignGroups(procs)
+
+	// excludes 对子孙进程也有效
+	if len(procs) != 1 || procs[0].PID != 1234 {
+		t.Errorf("%v", procs)
+	}
+
+	p.excludes = nil
+	procs, _ = s.Snap(p.matchSource)
+	procs = p.assignGroups(procs)
+	if len(procs) != 2 || findProcByPID(procs, 1240) == nil || !findProcByPID(procs, 1240).Descendant {
+		t.Errorf("%v", procs)
+	}
+}
+
+func TestReadSmapsByGroup(t *testing.T) {
+	logic, _ := NewGroup("logic", []string{`service_box`}, nil, "", "")
+	logic.Smaps = true
+	other, _ := NewGroup("other", []string{`init`}, nil, "", "")
+
+	p := NewProcessMonitor()
+	p.SetSource(NewProcfsSource("testdata/proc"))
+	p.SetGroups([]*Group{logic, other})
+
+	procs, err := p.source.Snap(p.matchSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Procs = p.assignGroups(procs)
+	p.readSmaps()
+
+	if proc := p.FindProcByPID(1234); proc == nil || !proc.Smaps {
+		t.Errorf("%v", proc)
+	}
+	if proc := p.FindProcByPID(1); proc == nil || proc.Smaps {
+		t.Errorf("%v", proc)
+	}
+}
+
+func TestGroupMatch(t *testing.T) {
+	g, err := NewGroup("gate", []string{`service_box`}, []string{`logic`}, "game", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		proc *Proc
+		want bool
+	}{
+		{&Proc{Command: "service_box --config gate.xml", User: "game"}, true},
+		{&Proc{Command: "service_box --config gate.xml", User: "root"}, false},
+		{&Proc{Command: "service_box --config logic.xml", User: "game"}, false},
+		{&Proc{Command: "nginx", User: "game"}, false},
+	} {
+		if g.Match(c.proc) != c.want {
+			t.Errorf("%v: want %v", c.proc, c.want)
+		}
+	}
+
+	if _, err := NewGroup("bad", []string{`(`}, nil, "", ""); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestParseCgroup(t *testing.T) {
+	v1 := "12:pids:/user.slice\n1:name=systemd:/user.slice/session-1.scope\n"
+	if c, container, unit := parseCgroup([]byte(v1)); c != "/user.slice/session-1.scope" || container != "" || unit != "session-1.scope" {
+		t.Error(c, container, unit)
+	}
+
+	hybrid := "1:name=systemd:/system.slice/a.service\n0::/system.slice/a.service\n"
+	if c, _, unit := parseCgroup([]byte(hybrid)); c != "/system.slice/a.service" || unit != "a.service" {
+		t.Error(c, unit)
+	}
+
+	id := "3f2a9c0b7d1e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a"
+	for _, data := range []string{
+		"0::/system.slice/docker-" + id + ".scope\n",
+		"11:memory:/docker/" + id + "\n1:name=systemd:/docker/" + id + "\n",
+		"0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1.slice/cri-containerd-" + id + ".scope\n",
+	} {
+		if _, container, _ := parseCgroup([]byte(data)); container != id {
+			t.Errorf("%s: %s", data, container)
+		}
+	}
+}
+
+func TestMatchContainerAndUnit(t *testing.T) {
+	procs := func() []*Proc {
+		return []*Proc{
+			{PID: 1, Command: "/sbin/init", Unit: "init.scope"},
+			{PID: 100, PPID: 1, Command: "nginx: master process", Unit: "nginx.service"},
+			{PID: 200, PPID: 1, Command: "/app/server", ContainerID: "3f2a9c", Unit: "docker-3f2a9c.scope"},
+			{PID: 300, PPID: 1, Command: "/app/server", ContainerID: "77aa00", Unit: "docker-77aa00.scope"},
+		}
+	}
+
+	p := NewProcessMonitor(`^/sbin/init`)
+	p.AddContainerIncludes(`^3f2a`)
+	p.AddUnitIncludes(`^nginx\.service$`)
+	// 有容器、unit的条件时，要读了cgroup才知道
+	if !p.matchSource("/app/server") {
+		t.Error("should pass all commands to source")
+	}
+
+	rez := p.assignGroups(procs())
+	if len(rez) != 3 || findProcByPID(rez, 300) != nil {
+		t.Errorf("%v", rez)
+	}
+
+	p.AddUnitExcludes(`^docker-`)
+	rez = p.assignGroups(procs())
+	if len(rez) != 2 || findProcByPID(rez, 200) != nil {
+		t.Errorf("%v", rez)
+	}
+
+	// 只有容器的条件时，不在容器里的进程都不记录
+	p.ClearBlacklist()
+	p.AddContainerIncludes(`.*`)
+	rez = p.assignGroups(procs())
+	if len(rez) != 2 || findProcByPID(rez, 1) != nil || findProcByPID(rez, 100) != nil {
+		t.Errorf("%v", rez)
+	}
+}
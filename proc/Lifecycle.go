@@ -0,0 +1,166 @@
+package proc
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EventType 进程生命周期事件的类型
+type EventType string
+
+const (
+	EventStart   EventType = "start"
+	EventExit    EventType = "exit"
+	EventRestart EventType = "restart"
+)
+
+// Event 两次Snap之间发生的进程生命周期事件
+type Event struct {
+	Type EventType
+	Time time.Time
+	// 属于组的进程用组名来判断重启，Command为空；不属于组的用可执行文件名，Group为空。
+	// 命令行参数每次都可能不一样，用整个命令行的话换了参数重启就认不出来了
+	Group   string
+	Command string
+	// start、restart 是新的进程，exit 是最后一次看到的进程
+	Proc *Proc
+}
+
+// 一个进程的身份。ps取不到启动时间，只能用命令行来区分被复用的pid
+type procID struct {
+	pid       int
+	startTime uint64
+	command   string
+}
+
+func idOf(p *Proc) procID {
+	if p.StartTime != 0 {
+		return procID{pid: p.PID, startTime: p.StartTime}
+	}
+	return procID{pid: p.PID, command: p.Command}
+}
+
+// 判断重启用的名字，见 Event
+type lifecycleName struct {
+	group   string
+	command string
+}
+
+func nameOf(p *Proc) lifecycleName {
+	if p.Group != "" {
+		return lifecycleName{group: p.Group}
+	}
+	return lifecycleName{command: executable(p.Command)}
+}
+
+// executable 命令行里可执行文件的名字，不带路径
+func executable(command string) string {
+	fs := strings.Fields(command)
+	if len(fs) == 0 {
+		return ""
+	}
+	return filepath.Base(fs[0])
+}
+
+// lifecycle 比较前后两次Snap的进程，得出哪些进程启动了、退出了。
+// 一个名字下有进程退出以后，window以内同一个名字下又有进程启动，算作重启
+type lifecycle struct {
+	window time.Duration
+
+	// 上一次Snap的进程，nil表示还没有Snap过
+	last map[procID]*Proc
+	// 每个进程第一次被看到的时刻
+	firstSeen map[procID]time.Time
+	// 还没有被新进程接上的退出时刻
+	exits map[lifecycleName][]time.Time
+}
+
+func newLifecycle(window time.Duration) *lifecycle {
+	return &lifecycle{
+		window:    window,
+		firstSeen: make(map[procID]time.Time),
+		exits:     make(map[lifecycleName][]time.Time),
+	}
+}
+
+// diff 和上一次比较，返回事件，并设置每个进程的FirstSeen。
+// 第一次只记下有哪些进程，不当成启动，不然monclient每次重启都会有一堆启动事件
+func (l *lifecycle) diff(now time.Time, procs []*Proc) []Event {
+	current := make(map[procID]*Proc)
+	firstSeen := make(map[procID]time.Time)
+	for _, p := range procs {
+		id := idOf(p)
+		current[id] = p
+
+		t, ok := l.firstSeen[id]
+		if !ok {
+			t = now
+		}
+		firstSeen[id] = t
+		p.FirstSeen = t
+	}
+
+	events := []Event{}
+	if l.last != nil {
+		// 先处理退出，这样同一次里的退出和启动也能算成重启
+		for id, p := range l.last {
+			if _, ok := current[id]; ok {
+				continue
+			}
+
+			name := nameOf(p)
+			l.exits[name] = append(l.exits[name], now)
+			events = append(events, Event{Type: EventExit, Time: now, Group: name.group, Command: name.command, Proc: p})
+			log.Printf("process exited: pid=%d group=%s cmd=%s uptime=%s cpu=%.1f rss=%d swap=%d threads=%d fds=%s\n",
+				p.PID, p.Group, p.Command, p.Uptime(now), p.CPU, p.RSS, p.Swap, p.Threads, fdsString(p))
+		}
+
+		l.expire(now)
+
+		for id, p := range current {
+			if _, ok := l.last[id]; ok {
+				continue
+			}
+
+			name := nameOf(p)
+			typ := EventStart
+			if exits := l.exits[name]; len(exits) > 0 {
+				typ = EventRestart
+				l.exits[name] = exits[1:]
+			}
+			events = append(events, Event{Type: typ, Time: now, Group: name.group, Command: name.command, Proc: p})
+			log.Printf("process %s: pid=%d group=%s cmd=%s\n", typ, p.PID, p.Group, p.Command)
+		}
+	}
+
+	l.last = current
+	l.firstSeen = firstSeen
+
+	return events
+}
+
+// expire 删掉超过window的退出，之后再启动的就不算重启了
+func (l *lifecycle) expire(now time.Time) {
+	for name, exits := range l.exits {
+		i := 0
+		for i < len(exits) && now.Sub(exits[i]) > l.window {
+			i++
+		}
+
+		if i == len(exits) {
+			delete(l.exits, name)
+		} else {
+			l.exits[name] = exits[i:]
+		}
+	}
+}
+
+func fdsString(p *Proc) string {
+	if p.FDs == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d/%d", p.FDs.Open, p.FDs.Limit)
+}
@@ -0,0 +1,103 @@
+package proc
+
+import (
+	"testing"
+	"time"
+)
+
+// countEvents 按 类型/组/命令行 统计事件
+func countEvents(events []Event) map[string]int {
+	rez := make(map[string]int)
+	for _, e := range events {
+		rez[string(e.Type)+"/"+e.Group+"/"+e.Command]++
+	}
+	return rez
+}
+
+func TestLifecycle(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLifecycle(time.Minute)
+
+	logic := &Proc{PID: 100, StartTime: 1, Command: "service_box logic.xml", Group: "logic"}
+	nginx := &Proc{PID: 200, Command: "nginx"}
+
+	// 第一次只是记下来
+	if events := l.diff(now, []*Proc{logic, nginx}); len(events) != 0 {
+		t.Errorf("%v", events)
+	}
+	if !logic.FirstSeen.Equal(now) {
+		t.Error(logic.FirstSeen)
+	}
+
+	// logic 崩了，换了个pid起来，命令行参数也不一样
+	now = now.Add(10 * time.Second)
+	logic2 := &Proc{PID: 101, StartTime: 50, Command: "service_box logic.xml --recover", Group: "logic"}
+	events := l.diff(now, []*Proc{logic2, {PID: 200, Command: "nginx"}})
+	counts := countEvents(events)
+	if len(events) != 2 || counts["exit/logic/"] != 1 || counts["restart/logic/"] != 1 {
+		t.Errorf("%v", events)
+	}
+	for _, e := range events {
+		if e.Type == EventExit && e.Proc != logic {
+			t.Errorf("exit should carry the last seen process: %v", e.Proc)
+		}
+	}
+
+	// nginx 退出，过了window才起来，不算重启
+	now = now.Add(10 * time.Second)
+	events = l.diff(now, []*Proc{logic2})
+	if counts := countEvents(events); len(events) != 1 || counts["exit//nginx"] != 1 {
+		t.Errorf("%v", events)
+	}
+
+	now = now.Add(2 * time.Minute)
+	events = l.diff(now, []*Proc{logic2, {PID: 201, Command: "nginx"}})
+	if counts := countEvents(events); len(events) != 1 || counts["start//nginx"] != 1 {
+		t.Errorf("%v", events)
+	}
+
+	// 一直在的进程FirstSeen不变
+	if !logic2.FirstSeen.Equal(time.Unix(1010, 0)) {
+		t.Error(logic2.FirstSeen)
+	}
+}
+
+func TestLifecycleRestartWithArgs(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLifecycle(time.Minute)
+	l.diff(now, []*Proc{{PID: 300, StartTime: 1, Command: "/opt/bin/worker --ts=1000"}})
+
+	// 不属于组的进程换了参数重启，按可执行文件认出来
+	now = now.Add(10 * time.Second)
+	events := l.diff(now, []*Proc{{PID: 301, StartTime: 2, Command: "/opt/bin/worker --ts=1010"}})
+	if counts := countEvents(events); len(events) != 2 || counts["exit//worker"] != 1 || counts["restart//worker"] != 1 {
+		t.Errorf("%v", events)
+	}
+}
+
+func TestLifecyclePIDReuse(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLifecycle(time.Minute)
+
+	l.diff(now, []*Proc{{PID: 100, StartTime: 1, Command: "a"}})
+
+	// 同一个pid，启动时间不一样，是另一个进程
+	events := l.diff(now.Add(time.Second), []*Proc{{PID: 100, StartTime: 2, Command: "a"}})
+	if counts := countEvents(events); len(events) != 2 || counts["exit//a"] != 1 || counts["restart//a"] != 1 {
+		t.Errorf("%v", events)
+	}
+}
+
+func TestUptime(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	p := &Proc{FirstSeen: time.Unix(900, 0)}
+	if p.Uptime(now) != 100*time.Second {
+		t.Error(p.Uptime(now))
+	}
+
+	p.StartedAt = time.Unix(500, 0)
+	if p.Uptime(now) != 500*time.Second {
+		t.Error(p.Uptime(now))
+	}
+}
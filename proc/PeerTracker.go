@@ -0,0 +1,127 @@
+package proc
+
+import (
+	"sort"
+
+	"github.com/wanghengwei/monclient/net"
+)
+
+// PeerLimit 一个监听端口按远端地址统计进来的流量时的限制
+type PeerLimit struct {
+	// 只给出进来流量最多的几个远端地址
+	Top int
+	// 最多给多少个远端地址加规则
+	MaxTracked int
+}
+
+// PeerTraffic 一个远端地址累计发到监听端口的流量
+type PeerTraffic struct {
+	Address string
+	Bytes   uint64
+	Packets uint64
+}
+
+// 一个监听socket的身份，进程启动时间用来区分被复用的pid
+type peerListenKey struct {
+	family    net.Family
+	protocol  net.Protocol
+	pid       int
+	startTime uint64
+	port      int
+}
+
+// peerTracker 记住每个监听端口加了规则的远端地址。连接断开以后地址还留着，
+// 短连接的客户端两次Snap之间发的流量也能算上；超过上限时先留正连着的，再留流量大的
+type peerTracker struct {
+	limits map[int]PeerLimit
+	// 远端地址到上一次的累计字节数
+	tracked map[peerListenKey]map[string]uint64
+}
+
+func newPeerTracker(limits map[int]PeerLimit) *peerTracker {
+	return &peerTracker{limits: limits, tracked: make(map[peerListenKey]map[string]uint64)}
+}
+
+// limit 一个端口是否要按远端地址统计
+func (t *peerTracker) limit(port int) (PeerLimit, bool) {
+	if t == nil {
+		return PeerLimit{}, false
+	}
+	l, ok := t.limits[port]
+	return l, ok
+}
+
+// update 把这次连着的远端地址加进来，去掉超过上限的，返回要加规则的远端地址。
+// 这次没出现的监听socket不再记录
+func (t *peerTracker) update(procs []*Proc) map[peerListenKey][]string {
+	rez := make(map[peerListenKey][]string)
+	tracked := make(map[peerListenKey]map[string]uint64)
+	for _, proc := range procs {
+		for _, l := range proc.ListenPorts {
+			limit, ok := t.limit(l.Port)
+			if !ok {
+				continue
+			}
+
+			key := peerListenKey{family: l.Family, protocol: l.Protocol, pid: proc.PID, startTime: proc.StartTime, port: l.Port}
+			peers := t.tracked[key]
+			if peers == nil {
+				peers = make(map[string]uint64)
+			}
+			connected := make(map[string]bool)
+			for _, addr := range l.connectedPeers {
+				connected[addr] = true
+				if _, ok := peers[addr]; !ok {
+					peers[addr] = 0
+				}
+			}
+
+			addrs := make([]string, 0, len(peers))
+			for addr := range peers {
+				addrs = append(addrs, addr)
+			}
+			sort.Slice(addrs, func(i, j int) bool {
+				a, b := addrs[i], addrs[j]
+				if connected[a] != connected[b] {
+					return connected[a]
+				}
+				if peers[a] != peers[b] {
+					return peers[a] > peers[b]
+				}
+				return a < b
+			})
+			if len(addrs) > limit.MaxTracked {
+				for _, addr := range addrs[limit.MaxTracked:] {
+					delete(peers, addr)
+				}
+				addrs = addrs[:limit.MaxTracked]
+			}
+
+			tracked[key] = peers
+			rez[key] = addrs
+		}
+	}
+
+	t.tracked = tracked
+	return rez
+}
+
+// top 记下这次读到的累计流量，返回流量最多的几个远端地址
+func (t *peerTracker) top(key peerListenKey, traffic []*PeerTraffic) []*PeerTraffic {
+	peers := t.tracked[key]
+	for _, pt := range traffic {
+		peers[pt.Address] = pt.Bytes
+	}
+
+	sort.Slice(traffic, func(i, j int) bool {
+		if traffic[i].Bytes != traffic[j].Bytes {
+			return traffic[i].Bytes > traffic[j].Bytes
+		}
+		return traffic[i].Address < traffic[j].Address
+	})
+	if limit, _ := t.limit(key.port); len(traffic) > limit.Top {
+		traffic = traffic[:limit.Top]
+	}
+
+	return traffic
+}
@@ -0,0 +1,77 @@
+package proc
+
+import (
+	"testing"
+
+	"github.com/wanghengwei/monclient/net"
+)
+
+// fakePeerBackend 按远端地址给peer规则填上计数，记下这次有哪些peer规则
+type fakePeerBackend struct {
+	bytes map[string]uint64
+	peers []string
+}
+
+func (b *fakePeerBackend) Snap(inputs []*net.InputItem, clients []*net.ClientConnection) error {
+	b.peers = nil
+	for _, item := range inputs {
+		if item.Peer == "" {
+			continue
+		}
+		b.peers = append(b.peers, item.Peer)
+		item.InBytes, item.InPackets = b.bytes[item.Peer], 1
+	}
+	return nil
+}
+
+func (b *fakePeerBackend) Close() error {
+	return nil
+}
+
+func TestPeerTraffic(t *testing.T) {
+	proc := &Proc{PID: 1234, StartTime: 100}
+	proc.AddListenPort(net.IPv4, net.TCP, 8080)
+	proc.AddListenPort(net.IPv4, net.TCP, 22)
+
+	b := &fakePeerBackend{bytes: map[string]uint64{"10.0.0.1": 100, "10.0.0.2": 300, "10.0.0.3": 200}}
+	p := NewProcessMonitor()
+	p.SetTrafficBackend(b)
+	p.SetPeerPorts(map[int]PeerLimit{8080: {Top: 2, MaxTracked: 3}})
+
+	snap := func(connected ...string) []*PeerTraffic {
+		for _, l := range proc.ListenPorts {
+			l.connectedPeers = nil
+		}
+		for _, addr := range connected {
+			proc.findListenPort(net.IPv4, net.TCP, 8080).addConnectedPeer(addr)
+		}
+		p.Procs = []*Proc{proc}
+		p.snapByTrafficMonitor()
+		if proc.findListenPort(net.IPv4, net.TCP, 22).Peers != nil {
+			t.Error("port 22 should not be tracked")
+		}
+		return proc.findListenPort(net.IPv4, net.TCP, 8080).Peers
+	}
+
+	peers := snap("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	if len(peers) != 2 || peers[0].Address != "10.0.0.2" || peers[0].Bytes != 300 || peers[1].Address != "10.0.0.3" {
+		t.Errorf("%v", peers)
+	}
+
+	// 断开的地址还留着
+	snap()
+	if len(b.peers) != 3 {
+		t.Errorf("%v", b.peers)
+	}
+
+	// 超过上限，先挤掉断开了的流量最小的
+	peers = snap("10.0.0.4")
+	if len(b.peers) != 3 || len(peers) != 2 || peers[0].Address != "10.0.0.2" {
+		t.Errorf("%v %v", b.peers, peers)
+	}
+	for _, addr := range b.peers {
+		if addr == "10.0.0.1" {
+			t.Errorf("%v", b.peers)
+		}
+	}
+}
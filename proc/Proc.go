@@ -5,6 +5,9 @@ import (
 	"log"
 	"regexp"
 	"strconv"
+	"time"
+
+	"github.com/wanghengwei/monclient/net"
 )
 
 var (
@@ -14,32 +17,116 @@ var (
 
 // Proc 表示一个进程
 type Proc struct {
-	PID           int
-	Command       string
+	PID  int
+	PPID int
+	// 进程启动时间，开机以后的jiffies。用来区分被复用的pid，ps取不到，为0
+	StartTime uint64
+	Command   string
+	// 进程的用户名，取不到用户名时是uid
+	User string
+	// 进程所在的cgroup路径，比如 /system.slice/nginx.service。ps取不到，为空
+	Cgroup string
+	// 从cgroup路径里认出来的容器ID和systemd unit，不在容器里、不是systemd管的为空
+	ContainerID string
+	Unit        string
+	// 所属的组，不属于任何组时为空
+	Group         string
 	CPU           float32
 	MemoryVirtual uint64
+	// 常驻内存，单位字节
+	RSS uint64
+	// 常驻内存里和别的进程共享的部分，包括文件映射和共享内存
+	Shared uint64
+	// 数据段和栈
+	Data uint64
+	// 被换出去的
+	Swap uint64
+	// 按共享进程数平摊以后的内存和独占的内存，读smaps才有，见 Smaps
+	PSS uint64
+	USS uint64
+	// 是否读了smaps，没读的话PSS和USS是0
+	Smaps bool
+
+	// 读写统计，读不到（比如没权限）时为nil
+	IO *IOStats
+	// 打开的文件数，读不到时为nil
+	FDs *FDStats
+	// 线程数和上下文切换次数，ps取不到，Threads为0
+	Threads                  int
+	VoluntaryCtxtSwitches    uint64
+	NonvoluntaryCtxtSwitches uint64
+	// 进程启动的时刻，取不到时是零值
+	StartedAt time.Time
+	// monclient第一次看到这个进程的时刻
+	FirstSeen time.Time
 	// 表示正在监听的端口
 	ListenPorts []*SocketListen
 	// 表示对外的连接
 	ClientConns []*ClientConnection
+
+	// 只是因为祖先进程匹配才记录的
+	Descendant bool
+	// 记录了的子进程，每次Snap重新建立
+	Children []*Proc
+}
+
+// IOStats 来自 /proc/<pid>/io
+type IOStats struct {
+	// read、write这些系统调用读写的字节数，包括读缓存的
+	ReadChars  uint64
+	WriteChars uint64
+	// 读写的系统调用次数
+	ReadSyscalls  uint64
+	WriteSyscalls uint64
+	// 真正读写存储设备的字节数
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+// FDStats 打开的文件数和上限
+type FDStats struct {
+	Open uint64
+	// RLIMIT_NOFILE的软限制，0表示没有限制
+	Limit uint64
 }
 
-// AddListenPort 添加一个监听的端口信息
-func (p *Proc) AddListenPort(port int) {
+// Uptime 进程运行了多久。不知道启动时间的话从第一次看到开始算
+func (p *Proc) Uptime(now time.Time) time.Duration {
+	if !p.StartedAt.IsZero() {
+		return now.Sub(p.StartedAt)
+	}
+	return now.Sub(p.FirstSeen)
+}
+
+// AddListenPort 添加一个监听的端口信息。udp的话是绑定的端口
+func (p *Proc) AddListenPort(family net.Family, protocol net.Protocol, port int) {
 	for _, item := range p.ListenPorts {
-		if item.Port == port {
+		if item.Family == family && item.Protocol == protocol && item.Port == port {
 			return
 		}
 	}
 
 	p.ListenPorts = append(p.ListenPorts, &SocketListen{
-		Port: port,
+		Family:   family,
+		Protocol: protocol,
+		Port:     port,
 	})
 }
 
-func (p *Proc) isListenPort(port int) bool {
+// findListenPort 找一个监听的端口，没有返回nil
+func (p *Proc) findListenPort(family net.Family, protocol net.Protocol, port int) *SocketListen {
+	for _, item := range p.ListenPorts {
+		if item.Family == family && item.Protocol == protocol && item.Port == port {
+			return item
+		}
+	}
+
+	return nil
+}
+
+func (p *Proc) isListenPort(protocol net.Protocol, port int) bool {
 	for _, c := range p.ListenPorts {
-		if c.Port == port {
+		if c.Protocol == protocol && c.Port == port {
 			return true
 		}
 	}
@@ -47,29 +134,54 @@ func (p *Proc) isListenPort(port int) bool {
 	return false
 }
 
-// AddClientConnections 增加一个对外的连接的信息
-func (p *Proc) AddClientConnection(addr string, port int) {
+// AddClientConnections 增加一个对外的连接的信息。汇总过的连接见 ClientConnection
+func (p *Proc) AddClientConnection(family net.Family, protocol net.Protocol, addr string, port int, networks ...string) {
 	for _, i := range p.ClientConns {
-		if i.Address == addr && i.Port == port {
+		if i.Family == family && i.Protocol == protocol && i.Address == addr && i.Port == port {
 			return
 		}
 	}
 
-	log.Printf("add an output connection: %s:%d\n", addr, port)
+	log.Printf("add an output connection(%s): %s:%d/%s\n", family, addr, port, protocol)
 
 	p.ClientConns = append(p.ClientConns, &ClientConnection{
-		Address: addr,
-		Port:    port,
+		Family:   family,
+		Protocol: protocol,
+		Address:  addr,
+		Port:     port,
+		Networks: networks,
 	})
 }
 
 // SocketListen 表示监听的socket
 type SocketListen struct {
+	// 地址族，双栈监听的端口会有ipv4和ipv6两条
+	Family net.Family
+	// tcp 或 udp
+	Protocol net.Protocol
 	// 端口
 	Port int
-	// 流量总计，单位字节
+	// 流量累计，单位字节。同一个进程只增不减
 	InBytes  uint64
 	OutBytes uint64
+	// 包数累计
+	InPackets  uint64
+	OutPackets uint64
+	// 按远端地址统计时进来流量最多的几个远端地址，没配置的端口为nil
+	Peers []*PeerTraffic
+
+	// 这次lsof看到的连到这个端口的远端地址
+	connectedPeers []string
+}
+
+// addConnectedPeer 记下一个连到这个端口的远端地址
+func (s *SocketListen) addConnectedPeer(addr string) {
+	for _, a := range s.connectedPeers {
+		if a == addr {
+			return
+		}
+	}
+	s.connectedPeers = append(s.connectedPeers, addr)
 }
 
 // NewSocketListenByString 通过lsof的输出文本来创建一个监听socket
@@ -91,12 +203,20 @@ func NewSocketListenByString(line string) *SocketListen {
 }
 
 func (s *SocketListen) String() string {
-	return fmt.Sprintf(":%d (in:%d, out:%d)", s.Port, s.InBytes, s.OutBytes)
+	return fmt.Sprintf(":%d/%s/%s (in:%d, out:%d)", s.Port, s.Protocol, s.Family, s.InBytes, s.OutBytes)
 }
 
 // ClientConnection 表示一个对外连接
 type ClientConnection struct {
+	Family   net.Family
+	Protocol net.Protocol
+	// 汇总过的连接：只按端口的Address为空；按网段的是网段，比如 10.1.0.0/24；按服务的是服务名
 	Address string
-	Port    int
+	// 0表示所有端口
+	Port int
+	// 按服务汇总时要统计的网段，为空表示统计Address
+	Networks []string
+	// 发送的累计字节数和包数
 	Bytes   uint64
+	Packets uint64
 }
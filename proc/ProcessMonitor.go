@@ -1,12 +1,10 @@
 package proc
 
 import (
-	"fmt"
 	"log"
 	"regexp"
+	"time"
 
-	"github.com/wanghengwei/monclient/cmdutil"
-	"github.com/wanghengwei/monclient/common"
 	"github.com/wanghengwei/monclient/lsof"
 	"github.com/wanghengwei/monclient/net"
 )
@@ -18,10 +16,42 @@ import (
 type ProcessMonitor struct {
 	Procs []*Proc
 
+	// 进程基本信息的来源，默认是ps
+	source Source
+	// socket信息的来源，默认是lsof
+	sockets lsof.Provider
+
 	includes []*regexp.Regexp
 	excludes []*regexp.Regexp
+	// 按容器ID、systemd unit选进程，要Source能给出cgroup
+	containerIncludes []*regexp.Regexp
+	containerExcludes []*regexp.Regexp
+	unitIncludes      []*regexp.Regexp
+	unitExcludes      []*regexp.Regexp
+	// 按顺序匹配，进程属于第一个匹配的组
+	groups []*Group
+	// 匹配的进程的子孙进程也记录
+	descendants bool
+
+	lifecycle *lifecycle
+	now       func() time.Time
+	// 最近一次Snap得出的事件
+	events []Event
+
+	// 读进程所在的unit、容器的cgroup资源用量，nil表示不读
+	cgroupReader *CgroupReader
+	// 最近一次Snap读到的cgroup
+	cgroups []*Cgroup
 
 	trafficMonitor *net.TrafficMonitor
+	// 对外连接怎么汇总，nil表示每个地址和端口单独统计
+	clients *ClientAggregator
+	// 为true时unit、容器里的进程按cgroup统计发出的流量，不再跟着一个个对外连接加规则
+	trafficByCgroup bool
+	// 最近一次Snap按cgroup统计的流量
+	cgroupTraffic []*CgroupTraffic
+	// 哪些监听端口按远端地址统计进来的流量，nil表示都不统计
+	peers *peerTracker
 
 	blacklistLocal  []func(int) bool
 	blacklistRemote []func(int) bool
@@ -33,10 +63,88 @@ func NewProcessMonitor(includes ...string) *ProcessMonitor {
 	for _, f := range includes {
 		p.includes = append(p.includes, regexp.MustCompile(f))
 	}
+	p.source = NewPSSource()
+	p.sockets = &lsof.Lsof{}
 	p.trafficMonitor = net.NewTrafficMonitor()
+	p.lifecycle = newLifecycle(5 * time.Minute)
+	p.now = time.Now
 	return p
 }
 
+// SetRestartWindow 进程退出以后多久以内同一个组（不属于组的话同样的命令行）又有进程启动算作重启，默认5分钟
+func (p *ProcessMonitor) SetRestartWindow(d time.Duration) {
+	p.lifecycle.window = d
+}
+
+// Events 返回最近一次Snap和上一次相比发生的事件
+func (p *ProcessMonitor) Events() []Event {
+	return p.events
+}
+
+// SetCgroupReader 设置从哪读cgroup的资源用量，nil表示不读。要Source能给出进程的cgroup
+func (p *ProcessMonitor) SetCgroupReader(r *CgroupReader) {
+	p.cgroupReader = r
+}
+
+// Cgroups 返回最近一次Snap时记录的进程所在的unit、容器的cgroup资源用量
+func (p *ProcessMonitor) Cgroups() []*Cgroup {
+	return p.cgroups
+}
+
+// SetSource 设置进程基本信息的来源
+func (p *ProcessMonitor) SetSource(s Source) {
+	p.source = s
+}
+
+// SetTrafficBackend 设置统计流量用的后端，默认是iptables
+func (p *ProcessMonitor) SetTrafficBackend(b net.Backend) {
+	p.trafficMonitor = net.NewTrafficMonitorWithBackend(b)
+}
+
+// SetTrafficByCgroup 设置是否按cgroup统计unit、容器里的进程发出的流量。
+// Backend不支持，或者进程不在unit、容器里的，还是按对外连接统计
+func (p *ProcessMonitor) SetTrafficByCgroup(b bool) {
+	p.trafficByCgroup = b
+}
+
+// CgroupTraffic 返回最近一次Snap按cgroup统计的流量
+func (p *ProcessMonitor) CgroupTraffic() []*CgroupTraffic {
+	return p.cgroupTraffic
+}
+
+// SetClientAggregator 设置对外连接怎么汇总，nil表示每个地址和端口单独统计
+func (p *ProcessMonitor) SetClientAggregator(a *ClientAggregator) {
+	p.clients = a
+}
+
+// SetPeerPorts 设置哪些监听端口按远端地址统计进来的流量，key是端口，为空表示都不统计。
+// 每个远端地址一条规则，所以要用 PeerLimit 限制数量。已经记住的远端地址不会因为重新设置而丢掉
+func (p *ProcessMonitor) SetPeerPorts(ports map[int]PeerLimit) {
+	switch {
+	case len(ports) == 0:
+		p.peers = nil
+	case p.peers == nil:
+		p.peers = newPeerTracker(ports)
+	default:
+		p.peers.limits = ports
+	}
+}
+
+// Close 删除统计流量时创建的规则
+func (p *ProcessMonitor) Close() error {
+	return p.trafficMonitor.Close()
+}
+
+// TrafficRuleFailures 返回累计有多少条流量统计规则没能创建或删除
+func (p *ProcessMonitor) TrafficRuleFailures() uint64 {
+	return p.trafficMonitor.FailedRules()
+}
+
+// SetSocketProvider 设置socket信息的来源
+func (p *ProcessMonitor) SetSocketProvider(s lsof.Provider) {
+	p.sockets = s
+}
+
 // AddSinglePortToLocalBlacklist 添加一个本地端口到黑名单
 func (p *ProcessMonitor) AddSinglePortToLocalBlacklist(port int) {
 	f := func(x int) bool {
@@ -73,6 +181,10 @@ func (p *ProcessMonitor) ClearBlacklist() {
 	p.blacklistRemote = nil
 	p.includes = nil
 	p.excludes = nil
+	p.containerIncludes = nil
+	p.containerExcludes = nil
+	p.unitIncludes = nil
+	p.unitExcludes = nil
 }
 
 func (p *ProcessMonitor) inBlacklistOfLocal(port int) bool {
@@ -97,54 +209,94 @@ func (p *ProcessMonitor) inBlacklistOfRemote(port int) bool {
 	return false
 }
 
-// Includes todo
-func (p *ProcessMonitor) AddIncludes(pattern ...string) {
-	for _, pt := range pattern {
-		p.includes = append(p.includes, regexp.MustCompile(pt))
-	}
+// AddIncludes 添加需要记录的命令行的正则表达式。编译不了的跳过，返回第一个错误
+func (p *ProcessMonitor) AddIncludes(pattern ...string) error {
+	var err error
+	p.includes, err = appendPatterns(p.includes, pattern)
+	return err
 }
 
-// Excludes todo
-func (p *ProcessMonitor) AddExcludes(pattern ...string) {
-	for _, pt := range pattern {
-		p.excludes = append(p.excludes, regexp.MustCompile(pt))
-	}
+// AddExcludes 添加不需要记录的命令行的正则表达式。编译不了的跳过，返回第一个错误
+func (p *ProcessMonitor) AddExcludes(pattern ...string) error {
+	var err error
+	p.excludes, err = appendPatterns(p.excludes, pattern)
+	return err
 }
 
-func (p *ProcessMonitor) snapByPS() error {
-	// 执行ps获得进程基本信息
-	c := cmdutil.NewCommand("ps", "-ef")
-	c.SplitNumber = 8
-	lines, err := c.Run()
-	if err != nil {
-		return fmt.Errorf("run ps failed: %s", err)
-	}
+// AddContainerIncludes 添加需要记录的容器ID的正则表达式。编译不了的跳过，返回第一个错误
+func (p *ProcessMonitor) AddContainerIncludes(pattern ...string) error {
+	var err error
+	p.containerIncludes, err = appendPatterns(p.containerIncludes, pattern)
+	return err
+}
 
-	// 在刷新数据前清除掉老的数据
-	p.Procs = nil
+// AddContainerExcludes 添加不需要记录的容器ID的正则表达式。编译不了的跳过，返回第一个错误
+func (p *ProcessMonitor) AddContainerExcludes(pattern ...string) error {
+	var err error
+	p.containerExcludes, err = appendPatterns(p.containerExcludes, pattern)
+	return err
+}
 
-	for _, line := range lines[1:] {
-		item := new(Proc)
-		item.PID = line.GetField(1).AsInt()
-		if item.PID == 0 {
-			log.Printf("skip invalid line of ps: %s\n", line)
-			continue
+// AddUnitIncludes 添加需要记录的systemd unit的正则表达式，比如 ^nginx\.service$。编译不了的跳过，返回第一个错误
+func (p *ProcessMonitor) AddUnitIncludes(pattern ...string) error {
+	var err error
+	p.unitIncludes, err = appendPatterns(p.unitIncludes, pattern)
+	return err
+}
+
+// AddUnitExcludes 添加不需要记录的systemd unit的正则表达式。编译不了的跳过，返回第一个错误
+func (p *ProcessMonitor) AddUnitExcludes(pattern ...string) error {
+	var err error
+	p.unitExcludes, err = appendPatterns(p.unitExcludes, pattern)
+	return err
+}
+
+// SetGroups 设置进程分组。属于某个组的进程即使不在includes里也会记录
+func (p *ProcessMonitor) SetGroups(groups []*Group) {
+	p.groups = groups
+}
+
+// SetDescendants 设置是否记录匹配的进程的子孙进程，比如启动器fork出来的worker，它们的命令行往往认不出来
+func (p *ProcessMonitor) SetDescendants(b bool) {
+	p.descendants = b
+}
+
+// needTree 是否需要所有进程来建立进程树
+func (p *ProcessMonitor) needTree() bool {
+	if p.descendants {
+		return true
+	}
+
+	for _, g := range p.groups {
+		if g.Descendants {
+			return true
 		}
+	}
 
-		item.Command = line.GetField(7).String()
-		if p.matchCommand(item.Command) {
-			p.Procs = append(p.Procs, item)
+	return false
+}
+
+func appendPatterns(res []*regexp.Regexp, patterns []string) ([]*regexp.Regexp, error) {
+	var firstErr error
+	for _, pt := range patterns {
+		re, err := regexp.Compile(pt)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
 		}
+		res = append(res, re)
 	}
 
-	return nil
+	return res, firstErr
 }
 
 func (p *ProcessMonitor) snapByLSOF() error {
-	lsof := &lsof.Lsof{}
-	result, err := lsof.Run()
+	result, err := p.sockets.Run()
 	if err != nil {
-		// lsof出错不是很重要，就是没了端口信息而已，忽视
+		// 出错不是很重要，就是没了端口信息而已，记下来就行
+		log.Printf("get sockets FAILED: %s\n", err)
 		return nil
 	}
 
@@ -161,7 +313,9 @@ func (p *ProcessMonitor) snapByLSOF() error {
 			continue
 		}
 
-		proc.AddListenPort(item.BindPort)
+		for _, family := range listenFamilies(item) {
+			proc.AddListenPort(family, toProtocol(item.Protocol), item.BindPort)
+		}
 	}
 
 	// 最后添加client连接，这是为了先把监听的端口搞定
@@ -172,7 +326,13 @@ func (p *ProcessMonitor) snapByLSOF() error {
 			continue
 		}
 
-		if proc.isListenPort(item.SourcePort) {
+		if proc.isListenPort(toProtocol(item.Protocol), item.SourcePort) {
+			// 连进来的，要按远端地址统计的话记下远端地址
+			if _, ok := p.peers.limit(item.SourcePort); ok {
+				if l := proc.findListenPort(toFamily(item.Family), toProtocol(item.Protocol), item.SourcePort); l != nil {
+					l.addConnectedPeer(item.TargetAddress)
+				}
+			}
 			log.Printf("%d is a listen port, skip\n", item.SourcePort)
 			continue
 		}
@@ -188,56 +348,89 @@ func (p *ProcessMonitor) snapByLSOF() error {
 			continue
 		}
 
-		proc.AddClientConnection(item.TargetAddress, item.TargetPort)
+		family := toFamily(item.Family)
+		addr, networks, port := p.clients.aggregate(family, item.TargetAddress, item.TargetPort)
+		proc.AddClientConnection(family, toProtocol(item.Protocol), addr, port, networks...)
 	}
 
 	return nil
 }
 
-func (p *ProcessMonitor) snapByTop() error {
-	cmd := cmdutil.NewCommand("top", "-b", "-n", "1")
-	cmd.SplitNumber = 12
-	cmd.IgnoreExitCode = true
-
-	lines, err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("run top failed: %s", err)
+func toFamily(f string) net.Family {
+	if f == lsof.IPv6 {
+		return net.IPv6
 	}
+	return net.IPv4
+}
 
-	for _, line := range lines {
-		if len(line.Fields) != 12 {
-			log.Printf("drop unwanted line: %s", line.String())
-			continue
-		}
-
-		pid := line.GetField(0).AsInt()
-		if pid == 0 {
-			continue
-		}
-
-		proc := p.FindProcByPID(pid)
-		if proc == nil {
-			continue
-		}
+func toProtocol(p string) net.Protocol {
+	if p == lsof.UDP {
+		return net.UDP
+	}
+	return net.TCP
+}
 
-		proc.CPU = line.GetField(8).AsFloat32()
-		proc.MemoryVirtual, err = common.DataStrToBytes(line.GetField(4).String())
-		if err != nil {
-			log.Printf("convert mem %s to bytes failed\n", line.GetField(4))
-		}
+// listenFamilies 一个监听端口需要统计的地址族。
+// 监听在ipv6通配地址上的socket默认是双栈的，ipv4的连接也会进来，所以两个都要
+func listenFamilies(item *lsof.ListenItem) []net.Family {
+	if item.Family == lsof.IPv6 && item.BindAddress == "*" {
+		return net.Families
 	}
+	return []net.Family{toFamily(item.Family)}
+}
 
-	return nil
+// clientTargets 一个对外连接要统计哪些地址，每个地址一条规则
+func clientTargets(c *ClientConnection) []string {
+	if len(c.Networks) > 0 {
+		return c.Networks
+	}
+	return []string{c.Address}
 }
 
 func (p *ProcessMonitor) snapByTrafficMonitor() error {
+	byCgroup := p.trafficByCgroup && p.trafficMonitor.SupportsCgroups()
+	if p.trafficByCgroup && !byCgroup {
+		log.Printf("traffic by cgroup is not supported, fall back to connections\n")
+	}
+
 	p.trafficMonitor.ClearAll()
+	var peers map[peerListenKey][]string
+	if p.peers != nil {
+		peers = p.peers.update(p.Procs)
+		for key, addrs := range peers {
+			for _, addr := range addrs {
+				p.trafficMonitor.AddPeerInput(key.family, key.protocol, key.pid, key.startTime, key.port, addr)
+			}
+		}
+	}
+
+	// 按cgroup统计的，同一个cgroup的进程只要一条规则，组用第一个进程的
+	scopes := []*CgroupTraffic{}
+	seen := make(map[string]bool)
 	for _, proc := range p.Procs {
 		for _, l := range proc.ListenPorts {
-			p.trafficMonitor.AddInput(proc.PID, l.Port)
+			p.trafficMonitor.AddInput(l.Family, l.Protocol, proc.PID, proc.StartTime, l.Port)
+		}
+
+		if byCgroup {
+			if path := cgroupScope(proc); path != "" {
+				if !seen[path] {
+					seen[path] = true
+					scopes = append(scopes, &CgroupTraffic{Path: path, Group: proc.Group, ContainerID: proc.ContainerID, Unit: proc.Unit})
+					for _, family := range net.Families {
+						p.trafficMonitor.AddCgroup(family, path)
+					}
+				}
+				// 发出的流量已经算在cgroup里了，不再按连接统计和导出
+				proc.ClientConns = nil
+				continue
+			}
 		}
+
 		for _, c := range proc.ClientConns {
-			p.trafficMonitor.AddClientConnection(proc.PID, c.Address, c.Port)
+			for _, addr := range clientTargets(c) {
+				p.trafficMonitor.AddClientConnection(c.Family, c.Protocol, proc.PID, proc.StartTime, addr, c.Port)
+			}
 		}
 	}
 
@@ -250,25 +443,239 @@ func (p *ProcessMonitor) snapByTrafficMonitor() error {
 
 	for _, proc := range p.Procs {
 		for _, l := range proc.ListenPorts {
-			l.InBytes, l.OutBytes = p.trafficMonitor.FindInputTraffics(proc.PID, l.Port)
+			in, out := p.trafficMonitor.FindInputTraffics(l.Family, l.Protocol, proc.PID, l.Port)
+			l.InBytes, l.InPackets = in.Bytes, in.Packets
+			l.OutBytes, l.OutPackets = out.Bytes, out.Packets
+
+			key := peerListenKey{family: l.Family, protocol: l.Protocol, pid: proc.PID, startTime: proc.StartTime, port: l.Port}
+			if addrs, ok := peers[key]; ok {
+				traffic := make([]*PeerTraffic, 0, len(addrs))
+				for _, addr := range addrs {
+					in := p.trafficMonitor.FindPeerInput(l.Family, l.Protocol, proc.PID, l.Port, addr)
+					traffic = append(traffic, &PeerTraffic{Address: addr, Bytes: in.Bytes, Packets: in.Packets})
+				}
+				l.Peers = p.peers.top(key, traffic)
+			}
 		}
 
 		for _, l := range proc.ClientConns {
-			l.Bytes = p.trafficMonitor.FindClientOutput(proc.PID, l.Address, l.Port)
+			l.Bytes, l.Packets = 0, 0
+			for _, addr := range clientTargets(l) {
+				out := p.trafficMonitor.FindClientOutput(l.Family, l.Protocol, proc.PID, addr, l.Port)
+				l.Bytes += out.Bytes
+				l.Packets += out.Packets
+			}
+		}
+	}
+
+	for _, s := range scopes {
+		for _, family := range net.Families {
+			out := p.trafficMonitor.FindCgroupOutput(family, s.Path)
+			s.Bytes += out.Bytes
+			s.Packets += out.Packets
 		}
 	}
+	p.cgroupTraffic = scopes
 
 	return nil
 }
 
-// 检查一个命令行是否应当被记录。判断条件包括includes条件和exludes条件。
-func (p *ProcessMonitor) matchCommand(c string) bool {
-	// 先排除一些内定的
+// 内定不记录的命令行：ps自己和内核线程
+func ignoredCommand(c string) bool {
 	if c == "ps -ef" {
+		return true
+	}
+
+	matched, _ := regexp.MatchString(`^\[.*\]$`, c)
+	return matched
+}
+
+// matchSource 给Source用的，命令行匹配includes条件，或者可能属于某个组。
+// 要记录子孙进程的话，谁是谁的子孙进程要拿到所有进程才知道，所以都要
+func (p *ProcessMonitor) matchSource(c string) bool {
+	if ignoredCommand(c) {
 		return false
 	}
 
-	if matched, _ := regexp.MatchString(`^\[.*\]$`, c); matched {
+	// 容器和unit要读了cgroup才知道
+	if p.needTree() || p.filterCgroup() {
+		return true
+	}
+
+	if p.matchCommand(c) {
+		return true
+	}
+
+	for _, g := range p.groups {
+		if g.matchCommand(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// assignGroups 建立进程树，给每个进程设置所属的组，并去掉不需要记录的进程。
+// 用户、cgroup这些要拿到进程信息以后才能判断，所以Source给的进程会多一些
+func (p *ProcessMonitor) assignGroups(procs []*Proc) []*Proc {
+	byPID := make(map[int]*Proc)
+	children := make(map[int][]*Proc)
+	for _, proc := range procs {
+		byPID[proc.PID] = proc
+	}
+	for _, proc := range procs {
+		// pid 1 的 ppid 是0，也不能是自己的子进程
+		if _, ok := byPID[proc.PPID]; ok && proc.PPID != proc.PID {
+			children[proc.PPID] = append(children[proc.PPID], proc)
+		}
+	}
+
+	groups := make(map[string]*Group)
+	for _, g := range p.groups {
+		groups[g.Name] = g
+	}
+
+	kept := make(map[int]bool)
+	// 从根往下走，父进程的结果都有了才处理子进程
+	var walk func(proc *Proc, parent *Proc)
+	walk = func(proc *Proc, parent *Proc) {
+		for _, g := range p.groups {
+			if g.Match(proc) {
+				proc.Group = g.Name
+				break
+			}
+		}
+
+		matched := proc.Group != "" || p.match(proc)
+
+		inherited := false
+		if parent != nil && kept[parent.PID] {
+			if proc.Group == "" && parent.Group != "" && groups[parent.Group].Descendants {
+				proc.Group = parent.Group
+				inherited = true
+			}
+			if p.descendants && !p.excluded(proc) {
+				inherited = true
+			}
+		}
+
+		if matched || inherited {
+			kept[proc.PID] = true
+			proc.Descendant = !matched
+		}
+
+		for _, c := range children[proc.PID] {
+			walk(c, proc)
+		}
+	}
+	for _, proc := range procs {
+		if parent, ok := byPID[proc.PPID]; !ok || parent == proc {
+			walk(proc, nil)
+		}
+	}
+
+	rez := []*Proc{}
+	for _, proc := range procs {
+		if !kept[proc.PID] {
+			continue
+		}
+		rez = append(rez, proc)
+		if parent, ok := byPID[proc.PPID]; ok && parent != proc && kept[parent.PID] {
+			parent.Children = append(parent.Children, proc)
+		}
+	}
+
+	return rez
+}
+
+// readSmaps 给需要的组里的进程读smaps。Source不支持的话就算了
+func (p *ProcessMonitor) readSmaps() {
+	r, ok := p.source.(SmapsReader)
+	if !ok {
+		return
+	}
+
+	smaps := make(map[string]bool)
+	for _, g := range p.groups {
+		smaps[g.Name] = g.Smaps
+	}
+
+	for _, proc := range p.Procs {
+		if proc.Group == "" || !smaps[proc.Group] {
+			continue
+		}
+
+		// 进程可能刚退出，读不到不影响别的数据
+		if err := r.ReadSmaps(proc); err != nil {
+			log.Printf("read smaps of %d failed: %s\n", proc.PID, err)
+		}
+	}
+}
+
+// filterCgroup 是否有按容器、unit选进程的条件
+func (p *ProcessMonitor) filterCgroup() bool {
+	return len(p.containerIncludes) > 0 || len(p.containerExcludes) > 0 || len(p.unitIncludes) > 0 || len(p.unitExcludes) > 0
+}
+
+// match 检查一个进程是否应当被记录。命令行、容器、unit的includes有一个匹配就行，
+// 三种includes都没写的话都记录。匹配任何一个excludes的不记录
+func (p *ProcessMonitor) match(proc *Proc) bool {
+	if ignoredCommand(proc.Command) || p.excluded(proc) {
+		return false
+	}
+
+	if len(p.includes) == 0 && len(p.containerIncludes) == 0 && len(p.unitIncludes) == 0 {
+		return true
+	}
+
+	return (len(p.includes) > 0 && p.matchCommand(proc.Command)) ||
+		matchCgroupField(p.containerIncludes, proc.ContainerID) ||
+		matchCgroupField(p.unitIncludes, proc.Unit)
+}
+
+// excluded 命令行、容器、unit是否匹配了excludes
+func (p *ProcessMonitor) excluded(proc *Proc) bool {
+	return matchAny(p.excludes, proc.Command) ||
+		matchCgroupField(p.containerExcludes, proc.ContainerID) ||
+		matchCgroupField(p.unitExcludes, proc.Unit)
+}
+
+// matchCgroupField 不在容器里、不是systemd管的进程，容器ID、unit为空，不匹配任何条件
+func matchCgroupField(res []*regexp.Regexp, s string) bool {
+	return s != "" && matchAny(res, s)
+}
+
+// readCgroups 读记录了的进程所在的unit、容器的cgroup。同一个cgroup里有多个进程的只读一次，
+// 组用第一个进程的
+func (p *ProcessMonitor) readCgroups() {
+	p.cgroups = nil
+	if p.cgroupReader == nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, proc := range p.Procs {
+		path := cgroupScope(proc)
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		// cgroup可能随着进程退出刚被删掉
+		cg, err := p.cgroupReader.Read(path)
+		if err != nil {
+			log.Printf("read cgroup %s failed: %s\n", path, err)
+			continue
+		}
+		cg.Group, cg.ContainerID, cg.Unit = proc.Group, proc.ContainerID, proc.Unit
+		p.cgroups = append(p.cgroups, cg)
+	}
+}
+
+// 检查一个命令行是否应当被记录。判断条件包括includes条件和exludes条件。
+func (p *ProcessMonitor) matchCommand(c string) bool {
+	// 先排除一些内定的
+	if ignoredCommand(c) {
 		return false
 	}
 
@@ -310,24 +717,24 @@ func (p *ProcessMonitor) matchCommand(c string) bool {
 
 // FindProcByPID find proccess by pid. return nil if not found
 func (p *ProcessMonitor) FindProcByPID(pid int) *Proc {
-	for _, proc := range p.Procs {
-		if proc.PID == pid {
-			return proc
-		}
-	}
-
-	return nil
+	return findProcByPID(p.Procs, pid)
 }
 
-// Snap snap info by calling system command, ps/lsof etc.
+// Snap snap info from the process source, lsof and iptables
 func (p *ProcessMonitor) Snap() error {
-	log.Printf("snap by ps...")
-	err := p.snapByPS()
-	log.Printf("snap by ps DONE")
+	log.Printf("snap by source...")
+	procs, err := p.source.Snap(p.matchSource)
+	log.Printf("snap by source DONE")
 	if err != nil {
 		return err
 	}
 
+	// 在刷新数据前清除掉老的数据
+	p.Procs = p.assignGroups(procs)
+	p.readSmaps()
+	p.readCgroups()
+	p.events = nil
+
 	log.Printf("snap by lsof...")
 	err = p.snapByLSOF()
 	log.Printf("snap by lsof DONE")
@@ -335,13 +742,6 @@ func (p *ProcessMonitor) Snap() error {
 		return err
 	}
 
-	log.Printf("snap by top...")
-	err = p.snapByTop()
-	log.Printf("snap by top DONE")
-	if err != nil {
-		return err
-	}
-
 	log.Printf("snap by trafficmonitor...")
 	err = p.snapByTrafficMonitor()
 	log.Printf("snap by trafficmonitor DONE")
@@ -349,6 +749,9 @@ func (p *ProcessMonitor) Snap() error {
 		return err
 	}
 
+	// 整个Snap成功了才和上一次比较。失败时调用者拿不到事件，这次的事件留到下次成功时一起算
+	p.events = p.lifecycle.diff(p.now(), p.Procs)
+
 	return nil
 }
 
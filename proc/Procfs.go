@@ -0,0 +1,465 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 内核时钟频率，即 /proc/<pid>/stat 里 utime/stime 的单位。linux上基本都是100
+const clockTicks = 100
+
+// ProcfsSource 直接读取 /proc 来获取进程信息，不需要执行任何命令
+type ProcfsSource struct {
+	root     string
+	pageSize uint64
+	now      func() time.Time
+
+	// 上一次snap时每个进程的cpu时间，用来计算cpu使用率
+	lastTime time.Time
+	last     map[int]procfsSample
+
+	// uid -> 用户名，查过的就不再查了
+	users map[string]string
+	// 开机时间，第一次用到时从 /proc/stat 读
+	bootTime time.Time
+}
+
+// 一个进程在某次snap时的cpu时间
+type procfsSample struct {
+	// 进程启动时间，用来识别pid被复用的情况
+	startTime uint64
+	// utime + stime，单位是jiffies
+	jiffies uint64
+}
+
+// NewProcfsSource 创建一个ProcfsSource。root 一般是 /proc，测试时可以指向一个假的目录
+func NewProcfsSource(root string) *ProcfsSource {
+	return &ProcfsSource{
+		root:     root,
+		pageSize: uint64(os.Getpagesize()),
+		now:      time.Now,
+		last:     make(map[int]procfsSample),
+		users:    make(map[string]string),
+	}
+}
+
+// Snap 遍历 root 下所有的进程目录。cpu使用率是和上一次Snap相比得出的，因此第一次总是0
+func (s *ProcfsSource) Snap(match func(string) bool) ([]*Proc, error) {
+	entries, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, fmt.Errorf("read %s failed: %s", s.root, err)
+	}
+
+	now := s.now()
+	elapsed := now.Sub(s.lastTime).Seconds()
+	samples := make(map[int]procfsSample)
+	procs := []*Proc{}
+
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid <= 0 {
+			continue
+		}
+
+		// 进程随时可能退出，读不到就跳过
+		proc, sample, err := s.readProc(pid)
+		if err != nil {
+			log.Printf("skip pid %d: %s\n", pid, err)
+			continue
+		}
+
+		// 主机上的进程可能有几千个，先按命令行过滤，只给匹配的进程读别的文件
+		if !match(proc.Command) {
+			continue
+		}
+		if err := s.readDetails(proc); err != nil {
+			log.Printf("skip pid %d: %s\n", pid, err)
+			continue
+		}
+
+		samples[pid] = sample
+		if prev, ok := s.last[pid]; ok && prev.startTime == sample.startTime && elapsed > 0 && sample.jiffies >= prev.jiffies {
+			proc.CPU = float32(float64(sample.jiffies-prev.jiffies) / clockTicks / elapsed * 100)
+		}
+
+		procs = append(procs, proc)
+	}
+
+	s.last = samples
+	s.lastTime = now
+
+	return procs, nil
+}
+
+func (s *ProcfsSource) path(pid int, name string) string {
+	return filepath.Join(s.root, strconv.Itoa(pid), name)
+}
+
+// readProc 只读过滤要用的 stat 和 cmdline
+func (s *ProcfsSource) readProc(pid int) (*Proc, procfsSample, error) {
+	var sample procfsSample
+
+	stat, err := ioutil.ReadFile(s.path(pid, "stat"))
+	if err != nil {
+		return nil, sample, err
+	}
+
+	comm, fields, err := parseStat(stat)
+	if err != nil {
+		return nil, sample, err
+	}
+
+	// fields 从 state 开始，也就是 man proc 里的第3个字段
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	sample.startTime, _ = strconv.ParseUint(fields[19], 10, 64)
+	sample.jiffies = utime + stime
+
+	cmdline, err := ioutil.ReadFile(s.path(pid, "cmdline"))
+	if err != nil {
+		return nil, sample, err
+	}
+
+	ppid, _ := strconv.Atoi(fields[1])
+	proc := &Proc{
+		PID:       pid,
+		PPID:      ppid,
+		StartTime: sample.startTime,
+		Command:   parseCmdline(cmdline, comm),
+	}
+
+	return proc, sample, nil
+}
+
+// readDetails 给过滤以后留下的进程读内存、io、fd、用户和cgroup
+func (s *ProcfsSource) readDetails(proc *Proc) error {
+	pid := proc.PID
+	statm, err := ioutil.ReadFile(s.path(pid, "statm"))
+	if err != nil {
+		return err
+	}
+	ms := strings.Fields(string(statm))
+	if len(ms) < 2 {
+		return fmt.Errorf("bad statm: %s", statm)
+	}
+	size, _ := strconv.ParseUint(ms[0], 10, 64)
+	resident, _ := strconv.ParseUint(ms[1], 10, 64)
+	proc.MemoryVirtual = size * s.pageSize
+	proc.RSS = resident * s.pageSize
+	if len(ms) >= 6 {
+		shared, _ := strconv.ParseUint(ms[2], 10, 64)
+		data, _ := strconv.ParseUint(ms[5], 10, 64)
+		proc.Shared = shared * s.pageSize
+		proc.Data = data * s.pageSize
+	}
+
+	// status 里的 VmRSS 更精确一些，有就用它。内核线程没有这一项
+	status, err := s.readStatus(pid)
+	if err != nil {
+		return err
+	}
+	if rss, ok := status["VmRSS"]; ok {
+		proc.RSS = parseStatusBytes(rss)
+	}
+	if file, ok := status["RssFile"]; ok {
+		proc.Shared = parseStatusBytes(file) + parseStatusBytes(status["RssShmem"])
+	}
+	if data, ok := status["VmData"]; ok {
+		proc.Data = parseStatusBytes(data)
+	}
+	proc.Swap = parseStatusBytes(status["VmSwap"])
+	proc.Threads, _ = strconv.Atoi(status["Threads"])
+	proc.VoluntaryCtxtSwitches, _ = strconv.ParseUint(status["voluntary_ctxt_switches"], 10, 64)
+	proc.NonvoluntaryCtxtSwitches, _ = strconv.ParseUint(status["nonvoluntary_ctxt_switches"], 10, 64)
+
+	if boot := s.readBootTime(); !boot.IsZero() {
+		proc.StartedAt = boot.Add(time.Duration(proc.StartTime) * time.Second / clockTicks)
+	}
+
+	// 别的用户的进程，没有权限的话io和fd都读不到，不影响别的信息
+	proc.IO, _ = s.readIO(pid)
+	proc.FDs, _ = s.readFDs(pid)
+	if uids := strings.Fields(status["Uid"]); len(uids) > 0 {
+		proc.User = s.userName(uids[0])
+	}
+
+	// 没有cgroup的话不影响别的信息
+	if cgroup, err := ioutil.ReadFile(s.path(pid, "cgroup")); err == nil {
+		proc.Cgroup, proc.ContainerID, proc.Unit = parseCgroup(cgroup)
+	}
+
+	return nil
+}
+
+// ReadSmaps 从 /proc/<pid>/smaps_rollup 读PSS和USS。内核4.14以前没有这个文件
+func (s *ProcfsSource) ReadSmaps(p *Proc) error {
+	data, err := ioutil.ReadFile(s.path(p.PID, "smaps_rollup"))
+	if err != nil {
+		return err
+	}
+
+	rollup := parseKeyValues(data)
+	p.PSS = parseStatusBytes(rollup["Pss"])
+	p.USS = parseStatusBytes(rollup["Private_Clean"]) + parseStatusBytes(rollup["Private_Dirty"])
+	p.Smaps = true
+
+	return nil
+}
+
+// readStatus 把 /proc/<pid>/status 读成 key -> value
+func (s *ProcfsSource) readStatus(pid int) (map[string]string, error) {
+	data, err := ioutil.ReadFile(s.path(pid, "status"))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKeyValues(data), nil
+}
+
+// parseKeyValues 解析 status、smaps_rollup 这样每行是 key: value 的文件，不是这种格式的行跳过
+func parseKeyValues(data []byte) map[string]string {
+	rez := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		rez[kv[0]] = strings.TrimSpace(kv[1])
+	}
+
+	return rez
+}
+
+// readIO 读 /proc/<pid>/io
+func (s *ProcfsSource) readIO(pid int) (*IOStats, error) {
+	data, err := ioutil.ReadFile(s.path(pid, "io"))
+	if err != nil {
+		return nil, err
+	}
+
+	kv := parseKeyValues(data)
+	get := func(k string) uint64 {
+		n, _ := strconv.ParseUint(kv[k], 10, 64)
+		return n
+	}
+
+	return &IOStats{
+		ReadChars:     get("rchar"),
+		WriteChars:    get("wchar"),
+		ReadSyscalls:  get("syscr"),
+		WriteSyscalls: get("syscw"),
+		ReadBytes:     get("read_bytes"),
+		WriteBytes:    get("write_bytes"),
+	}, nil
+}
+
+// readFDs 数 /proc/<pid>/fd 里有多少个文件，上限从 /proc/<pid>/limits 读。
+// 只要名字，ReadDir 会对每个fd都lstat一次，fd多的进程很慢
+func (s *ProcfsSource) readFDs(pid int) (*FDStats, error) {
+	dir, err := os.Open(s.path(pid, "fd"))
+	if err != nil {
+		return nil, err
+	}
+	fds, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := ioutil.ReadFile(s.path(pid, "limits"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &FDStats{
+		Open:  uint64(len(fds)),
+		Limit: parseMaxOpenFiles(limits),
+	}, nil
+}
+
+// parseMaxOpenFiles 从limits里取出打开文件数的软限制，比如
+// Max open files            1024                 524288               files
+func parseMaxOpenFiles(data []byte) uint64 {
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+
+		fs := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fs) == 0 {
+			return 0
+		}
+		// unlimited 也是0
+		n, _ := strconv.ParseUint(fs[0], 10, 64)
+		return n
+	}
+
+	return 0
+}
+
+// readBootTime 从 /proc/stat 的btime读开机时间，读不到的话是零值，下次再试
+func (s *ProcfsSource) readBootTime() time.Time {
+	if !s.bootTime.IsZero() {
+		return s.bootTime
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.root, "stat"))
+	if err != nil {
+		return time.Time{}
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fs := strings.Fields(line)
+		if len(fs) == 2 && fs[0] == "btime" {
+			sec, err := strconv.ParseInt(fs[1], 10, 64)
+			if err == nil {
+				s.bootTime = time.Unix(sec, 0)
+			}
+			break
+		}
+	}
+
+	return s.bootTime
+}
+
+// userName 把uid转成用户名，转不了就用uid
+func (s *ProcfsSource) userName(uid string) string {
+	if name, ok := s.users[uid]; ok {
+		return name
+	}
+
+	name := uid
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	}
+	s.users[uid] = name
+
+	return name
+}
+
+// 容器的cgroup目录名，比如
+// docker:      /docker/<id> 或 /system.slice/docker-<id>.scope
+// containerd:  /kubepods/.../cri-containerd-<id>.scope
+// cri-o:       crio-<id>.scope
+// podman:      libpod-<id>.scope
+var containerPattern = regexp.MustCompile(`^(?:docker-|cri-containerd-|crio-|libpod-)?([0-9a-f]{64})(?:\.scope)?$`)
+
+// parseCgroup 从 /proc/<pid>/cgroup 里取出进程的cgroup路径、容器ID和systemd unit。
+// 每行的格式是 id:controllers:path。
+// 有cgroup v2的 0:: 那一行就用它的路径；否则是cgroup v1，各个controller的路径可能不一样，
+// 用systemd管理的 name=systemd 那一行，再没有就用第一行的
+func parseCgroup(data []byte) (path string, container string, unit string) {
+	v2, systemd, first := "", "", ""
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fs := strings.SplitN(line, ":", 3)
+		if len(fs) != 3 {
+			continue
+		}
+
+		switch {
+		case fs[0] == "0" && fs[1] == "":
+			v2 = fs[2]
+		case fs[1] == "name=systemd":
+			systemd = fs[2]
+		}
+		if first == "" {
+			first = fs[2]
+		}
+
+		if container == "" {
+			container = findContainer(fs[2])
+		}
+	}
+
+	switch {
+	case v2 != "":
+		path = v2
+	case systemd != "":
+		path = systemd
+	default:
+		path = first
+	}
+
+	return path, container, findUnit(path)
+}
+
+// findContainer 在cgroup路径里找容器ID，从最里面一层往外找
+func findContainer(path string) string {
+	parts := strings.Split(path, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if ms := containerPattern.FindStringSubmatch(parts[i]); ms != nil {
+			return ms[1]
+		}
+	}
+
+	return ""
+}
+
+// findUnit 路径里最里面一层 .service 或 .scope，比如 /system.slice/nginx.service 里的 nginx.service
+func findUnit(path string) string {
+	parts := strings.Split(path, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if strings.HasSuffix(parts[i], ".service") || strings.HasSuffix(parts[i], ".scope") {
+			return parts[i]
+		}
+	}
+
+	return ""
+}
+
+// parseStat 解析 /proc/<pid>/stat。comm 可能包含空格和括号，所以以最后一个 ) 为界
+func parseStat(data []byte) (string, []string, error) {
+	s := string(data)
+	l := strings.IndexByte(s, '(')
+	r := strings.LastIndexByte(s, ')')
+	if l < 0 || r < l {
+		return "", nil, fmt.Errorf("bad stat: %s", s)
+	}
+
+	fields := strings.Fields(s[r+1:])
+	if len(fields) < 22 {
+		return "", nil, fmt.Errorf("too few fields in stat: %s", s)
+	}
+
+	return s[l+1 : r], fields, nil
+}
+
+// parseCmdline 把cmdline转成和ps一样的格式：参数用空格分隔，没有cmdline的（内核线程）显示成 [comm]
+func parseCmdline(data []byte, comm string) string {
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return "[" + comm + "]"
+	}
+
+	return string(bytes.Replace(data, []byte{0}, []byte{' '}, -1))
+}
+
+// parseStatusBytes 把status里形如 "1234 kB" 的值转成字节数
+func parseStatusBytes(v string) uint64 {
+	fs := strings.Fields(v)
+	if len(fs) == 0 {
+		return 0
+	}
+
+	n, err := strconv.ParseUint(fs[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	if len(fs) > 1 && fs[1] == "kB" {
+		n *= 1024
+	}
+
+	return n
+}
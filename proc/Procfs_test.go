@@ -0,0 +1,163 @@
+package proc
+
+import (
+	"testing"
+	"time"
+)
+
+func matchAll(string) bool {
+	return true
+}
+
+func TestProcfsSnap(t *testing.T) {
+	s := NewProcfsSource("testdata/proc")
+	s.pageSize = 4096
+
+	procs, err := s.Snap(matchAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(procs) != 4 {
+		t.Fatalf("%v", procs)
+	}
+
+	p := findProcByPID(procs, 1234)
+	if p == nil {
+		t.Fatalf("pid 1234 not found: %v", procs)
+	}
+	if p.Command != "/usr/local/bin/service_box --config /etc/game/logic.xml" {
+		t.Error(p.Command)
+	}
+	if p.MemoryVirtual != 128000*4096 {
+		t.Error(p.MemoryVirtual)
+	}
+	if p.RSS != 80000*1024 {
+		t.Error(p.RSS)
+	}
+	if p.StartTime != 5000 {
+		t.Error(p.StartTime)
+	}
+	if p.PPID != 1 {
+		t.Error(p.PPID)
+	}
+	if p.Shared != 16000*1024 || p.Data != 240000*1024 || p.Swap != 1024*1024 {
+		t.Errorf("%d %d %d", p.Shared, p.Data, p.Swap)
+	}
+	// smaps要单独读
+	if p.Smaps || p.PSS != 0 {
+		t.Errorf("%v", p)
+	}
+	if p.IO == nil || p.IO.ReadChars != 1000000 || p.IO.WriteSyscalls != 1500 || p.IO.WriteBytes != 8192 {
+		t.Errorf("%v", p.IO)
+	}
+	if p.FDs == nil || p.FDs.Open != 5 || p.FDs.Limit != 1024 {
+		t.Errorf("%v", p.FDs)
+	}
+	if p.Threads != 8 || p.VoluntaryCtxtSwitches != 5000 || p.NonvoluntaryCtxtSwitches != 200 {
+		t.Errorf("%v", p)
+	}
+	// 开机后5000个jiffies，也就是50秒
+	if !p.StartedAt.Equal(time.Unix(1600000050, 0)) {
+		t.Error(p.StartedAt)
+	}
+	// 第一次snap没有可比较的数据
+	if p.CPU != 0 {
+		t.Error(p.CPU)
+	}
+
+	// 没有io和fd的当成读不到
+	if init := findProcByPID(procs, 1); init == nil || init.IO != nil || init.FDs != nil {
+		t.Errorf("%v", init)
+	}
+
+	k := findProcByPID(procs, 2)
+	if k == nil || k.Command != "[kthreadd]" {
+		t.Errorf("%v", k)
+	}
+}
+
+func TestProcfsSnapMatch(t *testing.T) {
+	s := NewProcfsSource("testdata/proc")
+	procs, err := s.Snap(func(c string) bool {
+		return c == "/sbin/init splash"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(procs) != 1 || procs[0].PID != 1 {
+		t.Errorf("%v", procs)
+	}
+}
+
+func TestProcfsCPU(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewProcfsSource("testdata/proc")
+	s.now = func() time.Time { return now }
+
+	_, err := s.Snap(matchAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 假装10秒前 1234 少用了500个jiffies，即5秒cpu时间
+	sample := s.last[1234]
+	sample.jiffies -= 500
+	s.last[1234] = sample
+	// pid 1 的启动时间不一样，表示pid被复用了，不计算
+	sample = s.last[1]
+	sample.startTime++
+	sample.jiffies = 0
+	s.last[1] = sample
+
+	now = now.Add(10 * time.Second)
+	procs, err := s.Snap(matchAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := findProcByPID(procs, 1234); p == nil || p.CPU != 50 {
+		t.Errorf("%v", p)
+	}
+	if p := findProcByPID(procs, 1); p == nil || p.CPU != 0 {
+		t.Errorf("%v", p)
+	}
+}
+
+func TestParseStat(t *testing.T) {
+	comm, fields, err := parseStat([]byte("42 (a (b) c) R 1 42 42 0 -1 0 0 0 0 0 7 3 0 0 20 0 1 0 99 0 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if comm != "a (b) c" || fields[0] != "R" || fields[11] != "7" || fields[19] != "99" {
+		t.Error(comm, fields)
+	}
+}
+
+func TestProcfsReadSmaps(t *testing.T) {
+	s := NewProcfsSource("testdata/proc")
+
+	p := &Proc{PID: 1234}
+	if err := s.ReadSmaps(p); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Smaps || p.PSS != 70000*1024 || p.USS != 68000*1024 {
+		t.Errorf("%v", p)
+	}
+
+	// 没有smaps_rollup
+	if err := s.ReadSmaps(&Proc{PID: 1}); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestParseMaxOpenFiles(t *testing.T) {
+	if n := parseMaxOpenFiles([]byte("Max open files            unlimited            unlimited            files\n")); n != 0 {
+		t.Error(n)
+	}
+	if n := parseMaxOpenFiles([]byte("Max processes             63704                63704                processes\n")); n != 0 {
+		t.Error(n)
+	}
+}
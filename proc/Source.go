@@ -0,0 +1,139 @@
+package proc
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/wanghengwei/monclient/cmdutil"
+	"github.com/wanghengwei/monclient/common"
+)
+
+// Source 表示进程基本信息（pid、命令行、cpu、内存）的来源
+type Source interface {
+	// Snap 获取一次所有进程的信息。match 用来判断一个命令行是否需要记录
+	Snap(match func(string) bool) ([]*Proc, error)
+}
+
+// SmapsReader 可以读进程的smaps，拿到PSS和USS。读smaps比较慢，只对需要的进程读
+type SmapsReader interface {
+	ReadSmaps(p *Proc) error
+}
+
+// NewSource 根据名字创建Source。支持 ps 和 procfs
+func NewSource(name string) (Source, error) {
+	switch name {
+	case "ps":
+		return NewPSSource(), nil
+	case "procfs":
+		return NewProcfsSource("/proc"), nil
+	default:
+		return nil, fmt.Errorf("unknown process source: %s", name)
+	}
+}
+
+// PSSource 通过执行 ps 和 top 命令来获取进程信息
+type PSSource struct{}
+
+// NewPSSource 创建一个PSSource
+func NewPSSource() *PSSource {
+	return &PSSource{}
+}
+
+// Snap 先用ps找到匹配的进程，再用top补充cpu和内存
+func (s *PSSource) Snap(match func(string) bool) ([]*Proc, error) {
+	procs, err := s.snapByPS(match)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.snapByTop(procs)
+	if err != nil {
+		return nil, err
+	}
+
+	return procs, nil
+}
+
+func (s *PSSource) snapByPS(match func(string) bool) ([]*Proc, error) {
+	// 执行ps获得进程基本信息
+	c := cmdutil.NewCommand("ps", "-ef")
+	c.SplitNumber = 8
+	lines, err := c.Run()
+	if err != nil {
+		return nil, fmt.Errorf("run ps failed: %s", err)
+	}
+
+	procs := []*Proc{}
+
+	for _, line := range lines[1:] {
+		item := new(Proc)
+		item.PID = line.GetField(1).AsInt()
+		if item.PID == 0 {
+			log.Printf("skip invalid line of ps: %s\n", line)
+			continue
+		}
+
+		item.User = line.GetField(0).String()
+		item.PPID = line.GetField(2).AsInt()
+		item.Command = line.GetField(7).String()
+		if match(item.Command) {
+			procs = append(procs, item)
+		}
+	}
+
+	return procs, nil
+}
+
+func (s *PSSource) snapByTop(procs []*Proc) error {
+	cmd := cmdutil.NewCommand("top", "-b", "-n", "1")
+	cmd.SplitNumber = 12
+	cmd.IgnoreExitCode = true
+
+	lines, err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("run top failed: %s", err)
+	}
+
+	for _, line := range lines {
+		if len(line.Fields) != 12 {
+			log.Printf("drop unwanted line: %s", line.String())
+			continue
+		}
+
+		pid := line.GetField(0).AsInt()
+		if pid == 0 {
+			continue
+		}
+
+		proc := findProcByPID(procs, pid)
+		if proc == nil {
+			continue
+		}
+
+		proc.CPU = line.GetField(8).AsFloat32()
+		proc.MemoryVirtual, err = common.DataStrToBytes(line.GetField(4).String())
+		if err != nil {
+			log.Printf("convert mem %s to bytes failed\n", line.GetField(4))
+		}
+		proc.RSS, err = common.DataStrToBytes(line.GetField(5).String())
+		if err != nil {
+			log.Printf("convert res %s to bytes failed\n", line.GetField(5))
+		}
+		proc.Shared, err = common.DataStrToBytes(line.GetField(6).String())
+		if err != nil {
+			log.Printf("convert shr %s to bytes failed\n", line.GetField(6))
+		}
+	}
+
+	return nil
+}
+
+func findProcByPID(procs []*Proc, pid int) *Proc {
+	for _, proc := range procs {
+		if proc.PID == pid {
+			return proc
+		}
+	}
+
+	return nil
+}